@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// bench publishes messages on one connection and receives them on another.
+// Every payload starts with the time it was published, so the latency of
+// each message can be measured.
+func bench(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := flags.Int("n", 10000, "number of messages")
+	size := flags.Int("size", 128, "payload size in bytes, at least 8")
+	topic := flags.String("topic", "", "topic to publish on, random if empty")
+	window := flags.Int("window", 100, "messages published between waiting for the server, so its queues don't overflow")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *n < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *size < 8 {
+		*size = 8
+	}
+	if *topic == "" {
+		var buf [8]byte
+		rand.Read(buf[:])
+		*topic = "_BENCH." + hex.EncodeToString(buf[:])
+	}
+
+	subscriber, err := connect()
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+	publisher, err := connect()
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+	s, err := subscriber.Subscribe(ctx, *topic)
+	if err != nil {
+		return err
+	}
+	defer s.Cancel()
+	// The subscription is in place once this is acknowledged
+	err = subscriber.PublishSync(ctx, *topic+".ready", nil)
+	if err != nil {
+		return err
+	}
+
+	latencies := make(chan []time.Duration, 1)
+	var last time.Time
+	go func() {
+		var l []time.Duration
+		for len(l) < *n {
+			// Give up on the rest if they have been dropped
+			wait, cancel := context.WithTimeout(ctx, 2*time.Second)
+			msg, err := s.Next(wait)
+			cancel()
+			if err != nil {
+				break
+			}
+			if len(msg.Data) < 8 {
+				continue
+			}
+			last = time.Now()
+			sent := int64(binary.BigEndian.Uint64(msg.Data))
+			l = append(l, time.Duration(last.UnixNano()-sent))
+		}
+		latencies <- l
+	}()
+
+	start := time.Now()
+	data := make([]byte, *size)
+	for i := 0; i < *n; i++ {
+		binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+		if *window > 0 && i%*window == *window-1 {
+			err = publisher.PublishSync(ctx, *topic, data)
+		} else {
+			err = publisher.Publish(*topic, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Wait until the server has seen all of them
+	err = publisher.PublishSync(ctx, *topic+".done", nil)
+	if err != nil {
+		return err
+	}
+	published := time.Since(start)
+	l := <-latencies
+	received := last.Sub(start)
+
+	fmt.Printf("published %d messages of %d bytes in %v: %.0f msg/s, %.2f MB/s\n",
+		*n, *size, published.Round(time.Millisecond),
+		float64(*n)/published.Seconds(), float64(*n**size)/published.Seconds()/1e6)
+	fmt.Printf("received %d messages (%d lost) in %v: %.0f msg/s\n",
+		len(l), *n-len(l), received.Round(time.Millisecond), float64(len(l))/received.Seconds())
+	if len(l) == 0 {
+		return nil
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i] < l[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return l[int(p*float64(len(l)-1))]
+	}
+	fmt.Printf("latency min %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		l[0], percentile(0.5), percentile(0.9), percentile(0.99), l[len(l)-1])
+	return nil
+}
@@ -0,0 +1,179 @@
+// Command cps publishes and subscribes to topics from the command line.
+//
+//	cps [-server addr] sub [-decode hex|json|msgpack] [-group name] topic...
+//	cps [-server addr] pub topic [data|-]
+//	cps [-server addr] bench [-n count] [-size bytes] [-topic name] [-window count]
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps"
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+var server = flag.String("server", "", "address of the server, the default server if empty")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cps [-server addr] sub [-decode hex|json|msgpack] [-group name] topic...")
+		fmt.Fprintln(os.Stderr, "       cps [-server addr] pub topic [data|-]")
+		fmt.Fprintln(os.Stderr, "       cps [-server addr] bench [-n count] [-size bytes] [-topic name] [-window count]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "sub":
+		err = sub(ctx, args)
+	case "pub":
+		err = pub(ctx, args)
+	case "bench":
+		err = bench(ctx, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func connect() (*cps.CPS, error) {
+	var opts []cps.DialOption
+	if *server != "" {
+		opts = append(opts, cps.Address(*server))
+	}
+	return cps.New(opts...)
+}
+
+func sub(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sub", flag.ExitOnError)
+	decode := flags.String("decode", "", "show payloads as hex, json or msgpack instead of text")
+	group := flags.String("group", "", "receive the messages as a member of this group")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	format, ok := formats[*decode]
+	if !ok {
+		return fmt.Errorf("unknown decoding %q", *decode)
+	}
+
+	c, err := connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var opts []cps.Option
+	if *group != "" {
+		opts = append(opts, cps.Group(*group))
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, flags.NArg())
+	for _, topic := range flags.Args() {
+		s, err := c.Subscribe(ctx, topic, opts...)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := s.Next(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				mutex.Lock()
+				fmt.Printf("%s %s %s\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), msg.Topic, format(msg.Data))
+				mutex.Unlock()
+				msg.Ack()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	err = <-errs
+	if err == context.Canceled || err == cps.ErrCanceled {
+		return nil
+	}
+	return err
+}
+
+// formats turn payloads into something printable.
+var formats = map[string]func([]byte) string{
+	"": func(data []byte) string {
+		return string(data)
+	},
+	"hex": hex.EncodeToString,
+	"json": func(data []byte) string {
+		var buf bytes.Buffer
+		if json.Compact(&buf, data) != nil {
+			return fmt.Sprintf("(invalid JSON) %q", data)
+		}
+		return buf.String()
+	},
+	"msgpack": func(data []byte) string {
+		v, err := frame.Unmarshal(data)
+		if err != nil {
+			return fmt.Sprintf("(%s) %x", err.Error(), data)
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("(%s) %x", err.Error(), data)
+		}
+		return string(buf)
+	},
+}
+
+func pub(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("pub", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var data []byte
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		data = []byte(flags.Arg(1))
+	} else {
+		var err error
+		data, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return c.PublishSync(ctx, flags.Arg(0), data)
+}
@@ -0,0 +1,58 @@
+// Command infostore maintains the directory of an info store.
+//
+//	infostore reindex dir
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jakobvarmose/everything/infostore"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: infostore reindex dir")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "reindex":
+		err = reindex(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// reindex builds the secondary indexes of the store in a directory anew.
+// The store must not be open elsewhere.
+func reindex(args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	is, err := infostore.NewInfoStore(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := is.RebuildIndex(); err != nil {
+		is.Close()
+		return err
+	}
+	return is.Close()
+}
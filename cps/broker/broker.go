@@ -0,0 +1,522 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps"
+	"github.com/jakobvarmose/everything/cps/frame"
+	"github.com/jakobvarmose/everything/cps/store"
+)
+
+// Broker routes publications to subscribers. It is what cpsserver runs,
+// but it can also be embedded, for instance to test code that uses the cps
+// package without a real server.
+type Broker struct {
+	// Limits must be set before the broker starts serving
+	Limits Limits
+	// KeepAlive is how often clients are pinged. A client that has answered
+	// a ping, or sent one, is disconnected if nothing is received from it
+	// for two intervals. Zero disables pings. It must be set before the
+	// broker starts serving.
+	KeepAlive time.Duration
+	// Store keeps the publications on the topics passed to Persist. It
+	// must be set before the first call to Persist, which otherwise sets it
+	// to an in-memory store.
+	Store store.Store
+	// PeerSecret authenticates the other nodes of a cluster, which must be
+	// given the same secret. A connection is only treated as a node, and
+	// exempted from Limits, if its hello carries the secret, so a cluster
+	// can't be formed while it is empty. It must be set before the broker
+	// starts serving or connecting.
+	PeerSecret string
+
+	id            string
+	clients       sync.Map
+	seen          *seenSet
+	metrics       metrics
+	topicLimiters topicLimiters
+	deliveries    atomic.Uint64
+
+	// subscriptionsMutex serializes changes to subscriptions, so that a
+	// topic is only removed while it has no subscribers. Lookups don't take
+	// it.
+	subscriptionsMutex sync.Mutex
+	subscriptions      sync.Map
+
+	groupsMutex sync.Mutex
+	groups      map[string]map[string]*group
+
+	mutex    sync.Mutex
+	seq      uint64
+	interest map[string]int
+	// groupInterest counts the local members of each group
+	groupInterest map[groupKey]int
+	links         map[*link]bool
+	persisted     map[string]store.Retention
+	listeners     map[net.Listener]bool
+	closed        bool
+	done          chan struct{}
+}
+
+var ErrClosed = errors.New("broker closed")
+
+// New returns a broker. The id identifies it in a cluster and is chosen at
+// random if empty.
+func New(id string) *Broker {
+	if id == "" {
+		var buf [8]byte
+		rand.Read(buf[:])
+		id = hex.EncodeToString(buf[:])
+	}
+	return &Broker{
+		id:            id,
+		seen:          newSeenSet(1 << 16),
+		interest:      make(map[string]int),
+		groupInterest: make(map[groupKey]int),
+		links:         make(map[*link]bool),
+		persisted:     make(map[string]store.Retention),
+		listeners:     make(map[net.Listener]bool),
+		groups:        make(map[string]map[string]*group),
+		done:          make(chan struct{}),
+	}
+}
+
+// Serve accepts connections on l with a new broker.
+func Serve(l net.Listener) error {
+	return New("").Serve(l)
+}
+
+// Serve accepts connections on l until it is closed or the broker shuts
+// down, in which case it returns ErrClosed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	b.listeners[l] = true
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.listeners, l)
+		b.mutex.Unlock()
+	}()
+	for {
+		c, err := l.Accept()
+		select {
+		case <-b.done:
+			if c != nil {
+				c.Close()
+			}
+			return ErrClosed
+		default:
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		go b.handle(c, true)
+	}
+}
+
+// Shutdown stops accepting connections and the links to other cluster
+// nodes. It then tells all clients to reconnect elsewhere and closes their
+// connections once the frames queued for them have been written, or when
+// ctx expires.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	close(b.done)
+	for l := range b.listeners {
+		l.Close()
+	}
+	for l := range b.links {
+		l.conn.Close()
+	}
+	b.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	b.clients.Range(func(key interface{}, value interface{}) bool {
+		c := key.(*client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.shutdown(ctx)
+		}()
+		return true
+	})
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Pipe returns the client end of an in-memory connection to the broker.
+func (b *Broker) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go b.handle(server, true)
+	return client
+}
+
+// Client returns a cps client connected to the broker through Pipe.
+func (b *Broker) Client(opts ...cps.DialOption) (*cps.CPS, error) {
+	dial := func() (net.Conn, error) {
+		return b.Pipe(), nil
+	}
+	return cps.New(append([]cps.DialOption{cps.Dialer(dial)}, opts...)...)
+}
+
+// handle serves a client until it disconnects. Binary frames are only
+// negotiated if binary is set.
+func (b *Broker) handle(conn net.Conn, binary bool) {
+	c := newClient(conn, &b.metrics)
+	c.drained = func() { b.retryGroups(c) }
+	b.clients.Store(c, true)
+	b.metrics.connections.Add(1)
+	go c.writeLoop(b.KeepAlive)
+	defer b.drop(c)
+	r := frame.NewReader(conn)
+	r.Limit = b.frameLimit()
+	heartbeat := false
+	for {
+		if heartbeat {
+			conn.SetReadDeadline(time.Now().Add(2 * b.KeepAlive))
+		}
+		obj, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// The client stopped answering pings
+			b.metrics.halfOpen.Add(1)
+			return
+		}
+		if errors.Is(err, frame.ErrMalformed) {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		if len(obj) < 1 {
+			continue
+		}
+		switch obj[0] {
+		case "v":
+			if !binary {
+				continue
+			}
+			format, err := frame.Accept(conn, r, obj)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return
+			}
+			c.mutex.Lock()
+			c.format = format
+			c.mutex.Unlock()
+		case "h":
+			if len(obj) < 3 || obj[1] != "peer" {
+				continue
+			}
+			secret := ""
+			if len(obj) >= 4 {
+				secret, _ = obj[3].(string)
+			}
+			if !b.authenticPeer(secret) {
+				fmt.Fprintf(os.Stderr, "rejected peer hello from %s\n", conn.RemoteAddr())
+				continue
+			}
+			c.mutex.Lock()
+			// Peers must introduce themselves before subscribing
+			if len(c.topics) == 0 {
+				c.peer = true
+				c.id, _ = obj[2].(string)
+			}
+			c.mutex.Unlock()
+		case "s":
+			if len(obj) < 2 {
+				continue
+			}
+			str, _ := obj[1].(string)
+			name := ""
+			if len(obj) >= 3 {
+				name, _ = obj[2].(string)
+			}
+			var id interface{}
+			if len(obj) >= 4 {
+				// The client asked for an acknowledgement
+				id = obj[3]
+			}
+			var err error
+			if name != "" {
+				err = b.join(c, groupKey{str, name})
+			} else {
+				err = b.subscribe(c, str)
+			}
+			if err != nil {
+				b.metrics.limited.Add(1)
+				c.send(frame.NewEncoded([]interface{}{"e", id, err.Error()}))
+			} else if id != nil {
+				c.send(frame.NewEncoded([]interface{}{"a", id}))
+			}
+		case "u":
+			if len(obj) < 2 {
+				continue
+			}
+			str, _ := obj[1].(string)
+			name := ""
+			if len(obj) >= 3 {
+				name, _ = obj[2].(string)
+			}
+			if name != "" {
+				b.leave(c, groupKey{str, name})
+			} else {
+				b.unsubscribe(c, str)
+			}
+		case "k":
+			if len(obj) < 2 {
+				continue
+			}
+			id, _ := frame.Uint(obj[1])
+			b.ack(c, id)
+		case "p":
+			if len(obj) < 3 {
+				continue
+			}
+			var id interface{}
+			if len(obj) >= 5 {
+				// The publisher asked for an acknowledgement
+				id = obj[4]
+			}
+			str, _ := obj[1].(string)
+			data, ok := frame.Bytes(obj[2])
+			if !ok {
+				c.send(frame.NewEncoded([]interface{}{"e", id, "invalid payload"}))
+				continue
+			}
+			err := b.admit(c, str, len(data))
+			if err != nil {
+				b.metrics.limited.Add(1)
+				c.send(frame.NewEncoded([]interface{}{"e", id, err.Error()}))
+				continue
+			}
+			p := &publication{
+				topic: str,
+				data:  data,
+			}
+			if len(obj) >= 4 {
+				p.reply, _ = obj[3].(string)
+			}
+			if len(obj) >= 7 {
+				// Signatures are checked by the subscribers
+				p.publisher, _ = frame.Bytes(obj[5])
+				p.signature, _ = frame.Bytes(obj[6])
+			}
+			b.publish(p)
+			if id != nil {
+				c.send(frame.NewEncoded([]interface{}{"a", id}))
+			}
+		case "r":
+			if len(obj) < 5 {
+				continue
+			}
+			str, _ := obj[1].(string)
+			from, _ := frame.Uint(obj[2])
+			max, _ := frame.Uint(obj[3])
+			err := b.history(c, str, from, max, obj[4])
+			if err != nil {
+				c.send(frame.NewEncoded([]interface{}{"e", obj[4], err.Error()}))
+			} else {
+				c.send(frame.NewEncoded([]interface{}{"a", obj[4]}))
+			}
+		case "i":
+			c.send(frame.NewEncoded([]interface{}{"o"}))
+			// Clients that don't know about pings never send one, so
+			// only those that do are timed out
+			heartbeat = b.KeepAlive > 0
+		case "o":
+			heartbeat = b.KeepAlive > 0
+		case "x":
+			return
+		}
+	}
+}
+
+func (b *Broker) subscribe(c *client, topic string) error {
+	c.mutex.Lock()
+	full := !c.peer && b.Limits.MaxSubscriptions > 0 &&
+		len(c.topics)+len(c.groups) >= b.Limits.MaxSubscriptions && !c.topics[topic]
+	c.mutex.Unlock()
+	if full {
+		return ErrTooManySubscriptions
+	}
+	b.subscriptionsMutex.Lock()
+	m, _ := b.subscriptions.LoadOrStore(topic, new(sync.Map))
+	_, loaded := m.(*sync.Map).LoadOrStore(c, true)
+	b.subscriptionsMutex.Unlock()
+	if loaded {
+		return nil
+	}
+	c.mutex.Lock()
+	c.topics[topic] = true
+	c.mutex.Unlock()
+	if !c.peer {
+		b.addInterest(topic, 1)
+	}
+	return nil
+}
+
+func (b *Broker) unsubscribe(c *client, topic string) {
+	b.subscriptionsMutex.Lock()
+	m, ok := b.subscriptions.Load(topic)
+	if !ok {
+		b.subscriptionsMutex.Unlock()
+		return
+	}
+	_, loaded := m.(*sync.Map).LoadAndDelete(c)
+	if empty(m.(*sync.Map)) {
+		// Topics such as reply inboxes are used once, so they must not
+		// pile up
+		b.subscriptions.Delete(topic)
+	}
+	b.subscriptionsMutex.Unlock()
+	if !loaded {
+		return
+	}
+	c.mutex.Lock()
+	delete(c.topics, topic)
+	c.mutex.Unlock()
+	if !c.peer {
+		b.addInterest(topic, -1)
+	}
+}
+
+// empty reports whether m has no entries.
+func empty(m *sync.Map) bool {
+	empty := true
+	m.Range(func(key interface{}, value interface{}) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+// drop closes the connection and removes all its subscriptions.
+func (b *Broker) drop(c *client) {
+	c.close()
+	b.clients.Delete(c)
+	b.metrics.connections.Add(-1)
+	c.mutex.Lock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	groups := make([]groupKey, 0, len(c.groups))
+	for key := range c.groups {
+		groups = append(groups, key)
+	}
+	c.mutex.Unlock()
+	for _, topic := range topics {
+		b.unsubscribe(c, topic)
+	}
+	for _, key := range groups {
+		b.leave(c, key)
+	}
+}
+
+type publication struct {
+	topic     string
+	data      []byte
+	reply     string
+	publisher []byte
+	signature []byte
+	// remote is set for publications from other cluster nodes
+	remote bool
+}
+
+// message returns the frame that delivers the publication to clients.
+func (p *publication) message() *frame.Encoded {
+	obj := []interface{}{"p", p.topic, p.data}
+	if len(p.publisher) > 0 && len(p.signature) > 0 {
+		obj = append(obj, p.reply, p.publisher, p.signature)
+	} else if p.reply != "" {
+		obj = append(obj, p.reply)
+	}
+	return frame.NewEncoded(obj)
+}
+
+// publish sends a message published by a local client to all subscribers,
+// including the cluster nodes that have subscribers for the topic.
+func (b *Broker) publish(p *publication) {
+	b.mutex.Lock()
+	b.seq++
+	id := fmt.Sprintf("%s.%d", b.id, b.seq)
+	_, persist := b.persisted[p.topic]
+	b.mutex.Unlock()
+	b.seen.add(id)
+	b.metrics.published.Add(1)
+	if persist {
+		b.store(p)
+	}
+
+	msg := p.message()
+	fwd := frame.NewEncoded([]interface{}{"f", id, p.topic, p.data, p.reply, p.publisher, p.signature})
+	b.subscribers(p.topic, func(c *client) {
+		if c.peer {
+			if c.send(fwd) == nil {
+				b.metrics.forwarded.Add(1)
+			}
+		} else {
+			if c.send(msg) == nil {
+				b.metrics.delivered.Add(1)
+			}
+		}
+	})
+	b.deliverGroups(p)
+}
+
+// deliver sends a message forwarded by another cluster node to the local
+// clients. It is never forwarded again, so messages can't loop. Groups are
+// left to the originating node, see dispatch.
+func (b *Broker) deliver(p *publication) {
+	b.mutex.Lock()
+	_, persist := b.persisted[p.topic]
+	b.mutex.Unlock()
+	if persist {
+		b.store(p)
+	}
+	msg := p.message()
+	b.subscribers(p.topic, func(c *client) {
+		if !c.peer && c.send(msg) == nil {
+			b.metrics.delivered.Add(1)
+		}
+	})
+}
+
+// subscribers calls f for each subscriber of topic.
+func (b *Broker) subscribers(topic string, f func(c *client)) {
+	m, ok := b.subscriptions.Load(topic)
+	if !ok {
+		return
+	}
+	m.(*sync.Map).Range(func(key interface{}, value interface{}) bool {
+		f(key.(*client))
+		return true
+	})
+}
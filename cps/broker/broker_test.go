@@ -0,0 +1,184 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+func TestMixedFormats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go New("a").Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := frame.NewReader(conn)
+	format, err := frame.Negotiate(conn, r, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != frame.Binary {
+		t.Fatal("server didn't accept binary frames")
+	}
+	send := func(obj ...interface{}) {
+		buf, err := frame.Encode(format, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(buf)
+	}
+	send("s", "t")
+
+	legacy := dial(t, l)
+	legacy.send(t, "s", "t")
+	time.Sleep(50 * time.Millisecond)
+
+	send("p", "t", []byte("hello"), "", uint64(1))
+	obj, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj[0] != "p" || string(obj[2].([]byte)) != "hello" {
+		t.Errorf("received %v", obj)
+	}
+	obj, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj[0] != "a" || obj[1] != uint64(1) {
+		t.Errorf("received %v, expected ack", obj)
+	}
+	line, err := legacy.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != `["p","t","aGVsbG8="]` {
+		t.Errorf("received %s", line)
+	}
+}
+
+func TestTopicsRemoved(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := New("a")
+	go b.Serve(l)
+
+	c := dial(t, l)
+	c.send(t, "s", "a")
+	c.send(t, "s", "b")
+	// Publishing on a topic without subscribers doesn't add it
+	c.send(t, "p", "c", "", "", 1)
+	if _, err := c.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(b.topics()) == 2 })
+	c.send(t, "u", "a")
+	c.conn.Close()
+	waitFor(t, func() bool {
+		n := 0
+		b.subscriptions.Range(func(key interface{}, value interface{}) bool {
+			n++
+			return true
+		})
+		return n == 0
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New("a")
+	served := make(chan error, 1)
+	go func() {
+		served <- b.Serve(l)
+	}()
+
+	sub := dial(t, l)
+	sub.send(t, "s", "t")
+	// Wait until the subscription is in place
+	sub.send(t, "p", "other", "", "", 1)
+	if _, err := sub.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pub := dial(t, l)
+	pub.send(t, "p", "t", "aGVsbG8=", "", 1)
+	if _, err := pub.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`["p","t","aGVsbG8="]`, `["x","shutdown"]`} {
+		line, err := sub.recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("received %s, expected %s", line, expected)
+		}
+	}
+	if _, err := sub.recv(time.Second); err != io.EOF {
+		t.Errorf("%v, expected EOF", err)
+	}
+	if err := <-served; err != ErrClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("still accepting connections")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := New("a")
+	b.KeepAlive = 50 * time.Millisecond
+	go b.Serve(l)
+
+	c := dial(t, l)
+	c.send(t, "i")
+	line, err := c.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != `["o"]` {
+		t.Errorf("received %s, expected pong", line)
+	}
+	line, err = c.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != `["i"]` {
+		t.Errorf("received %s, expected ping", line)
+	}
+	// Stop answering, as if the connection was lost
+	waitFor(t, func() bool {
+		return b.metrics.halfOpen.Load() == 1
+	})
+	waitFor(t, func() bool {
+		return b.metrics.connections.Load() == 0
+	})
+}
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+// queueSize is the number of frames that may wait to be written to a
+// client before further frames are dropped.
+const queueSize = 256
+
+var (
+	errClosed    = errors.New("connection closed")
+	errQueueFull = errors.New("queue full")
+)
+
+// client is a connection accepted by the server. Other cluster nodes
+// connect as clients too, but introduce themselves with a hello frame.
+type client struct {
+	conn    net.Conn
+	metrics *metrics
+	since   time.Time
+	queue   chan []byte
+	bye     chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	limiter *limiter
+	// drained is called when the queue has been emptied after frames were
+	// dropped, if it is set
+	drained func()
+	dropped atomic.Bool
+
+	peer    bool
+	id      string
+	mutex   sync.Mutex
+	format  frame.Format
+	topics  map[string]bool
+	groups  map[groupKey]bool
+	pending map[uint64]*group
+}
+
+func newClient(conn net.Conn, m *metrics) *client {
+	return &client{
+		conn:    conn,
+		metrics: m,
+		since:   time.Now(),
+		queue:   make(chan []byte, queueSize),
+		bye:     make(chan []byte, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		topics:  make(map[string]bool),
+		groups:  make(map[groupKey]bool),
+		pending: make(map[uint64]*group),
+	}
+}
+
+// send queues a frame for writing. Frames are dropped if the client doesn't
+// keep up.
+func (c *client) send(e *frame.Encoded) error {
+	c.mutex.Lock()
+	format := c.format
+	c.mutex.Unlock()
+	buf, err := e.Bytes(format)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+	select {
+	case c.queue <- buf:
+		return nil
+	default:
+		c.metrics.dropped.Add(1)
+		c.dropped.Store(true)
+		return errQueueFull
+	}
+}
+
+// writeLoop writes the queued frames and, if keepAlive is non-zero, a ping
+// every keepAlive interval.
+func (c *client) writeLoop(keepAlive time.Duration) {
+	defer close(c.stopped)
+	var tick <-chan time.Time
+	if keepAlive > 0 {
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+		tick = t.C
+	}
+	ping := frame.NewEncoded([]interface{}{"i"})
+	for {
+		select {
+		case <-tick:
+			c.mutex.Lock()
+			format := c.format
+			c.mutex.Unlock()
+			buf, err := ping.Bytes(format)
+			if err != nil || c.write(buf) != nil {
+				return
+			}
+		case buf := <-c.queue:
+			if c.write(buf) != nil {
+				return
+			}
+			if len(c.queue) == 0 && c.drained != nil && c.dropped.Swap(false) {
+				c.drained()
+			}
+		case bye := <-c.bye:
+			// Flush the queue and say goodbye
+			for len(c.queue) > 0 {
+				if c.write(<-c.queue) != nil {
+					return
+				}
+			}
+			c.write(bye)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) write(buf []byte) error {
+	start := time.Now()
+	_, err := c.conn.Write(buf)
+	c.metrics.writes.observe(time.Since(start).Seconds())
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+// shutdown writes the queued frames followed by a goodbye frame, which
+// tells the client to reconnect elsewhere, and then closes the connection.
+// Frames that can't be written before ctx expires are lost.
+func (c *client) shutdown(ctx context.Context) {
+	c.mutex.Lock()
+	format := c.format
+	c.mutex.Unlock()
+	bye, err := frame.Encode(format, []interface{}{"x", "shutdown"})
+	if err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			c.conn.SetWriteDeadline(deadline)
+		}
+		select {
+		case c.bye <- bye:
+		default:
+		}
+		select {
+		case <-c.stopped:
+		case <-ctx.Done():
+		}
+	}
+	c.close()
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,315 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+// The nodes of a cluster must form a full mesh: every node lists every
+// other node as a peer. A node connects to each of its peers and subscribes
+// there to the topics its own clients are interested in, so publications
+// are only forwarded to nodes that have subscribers. Forwarded messages
+// carry the id assigned by the originating node and are delivered to local
+// clients only. Groups work across the cluster, see group.go.
+//
+// A node introduces itself with ["h", "peer", id, secret]. The secret is
+// sent as is, so links between nodes should not cross untrusted networks.
+
+// authenticPeer reports whether secret is the PeerSecret of the broker.
+func (b *Broker) authenticPeer(secret string) bool {
+	return b.PeerSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(b.PeerSecret)) == 1
+}
+
+// link is a connection to a peer. Frames are queued and written by
+// writeLoop, so that senders never wait for the peer, even while holding
+// the broker's lock. Nothing is dropped, as the peer's view of our
+// subscriptions depends on every frame.
+type link struct {
+	conn   net.Conn
+	format frame.Format
+	mutex  sync.Mutex
+	queue  [][]byte
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+func newLink(conn net.Conn, format frame.Format) *link {
+	return &link{
+		conn:   conn,
+		format: format,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// send queues a frame for writing.
+func (l *link) send(obj []interface{}) error {
+	buf, err := frame.Encode(l.format, obj)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.queue = append(l.queue, buf)
+	l.mutex.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop writes the queued frames until the link is closed. The
+// connection is closed if a write fails, which ends runLink.
+func (l *link) writeLoop() {
+	for {
+		select {
+		case <-l.wake:
+			l.mutex.Lock()
+			queue := l.queue
+			l.queue = nil
+			l.mutex.Unlock()
+			for _, buf := range queue {
+				_, err := l.conn.Write(buf)
+				if err != nil {
+					l.conn.Close()
+					return
+				}
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// ping pings the peer every interval until stop is closed.
+func (l *link) ping(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.send([]interface{}{"i"})
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Connect keeps a link to the peer at addr open. It returns when the broker
+// shuts down.
+func (b *Broker) Connect(addr string) {
+	for {
+		err := b.runLink(addr)
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		select {
+		case <-time.After(time.Second):
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Broker) runLink(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := frame.NewReader(conn)
+	r.Limit = b.frameLimit()
+	format, err := frame.Negotiate(conn, r, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	l := newLink(conn, format)
+	go l.writeLoop()
+	defer close(l.done)
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	err = l.send([]interface{}{"h", "peer", b.id, b.PeerSecret})
+	for topic := range b.interest {
+		if err == nil {
+			err = l.send([]interface{}{"s", topic})
+		}
+	}
+	for key := range b.groupInterest {
+		if err == nil {
+			err = l.send([]interface{}{"s", key.topic, key.name})
+		}
+	}
+	if err == nil {
+		b.links[l] = true
+	}
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		b.mutex.Lock()
+		delete(b.links, l)
+		b.mutex.Unlock()
+	}()
+	if b.KeepAlive > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go l.ping(b.KeepAlive, stop)
+	}
+
+	for {
+		if b.KeepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * b.KeepAlive))
+		}
+		obj, err := r.Read()
+		if errors.Is(err, frame.ErrMalformed) {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			b.metrics.halfOpen.Add(1)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if len(obj) == 1 && obj[0] == "i" {
+			l.send([]interface{}{"o"})
+			continue
+		}
+		if len(obj) >= 7 && obj[0] == "g" {
+			b.deliverGroup(obj)
+			continue
+		}
+		if len(obj) < 5 || obj[0] != "f" {
+			continue
+		}
+		id, _ := obj[1].(string)
+		if !b.seen.add(id) {
+			continue
+		}
+		str, _ := obj[2].(string)
+		data, ok := frame.Bytes(obj[3])
+		if !ok {
+			continue
+		}
+		p := &publication{
+			topic:  str,
+			data:   data,
+			remote: true,
+		}
+		p.reply, _ = obj[4].(string)
+		if len(obj) >= 7 {
+			p.publisher, _ = frame.Bytes(obj[5])
+			p.signature, _ = frame.Bytes(obj[6])
+		}
+		b.deliver(p)
+	}
+}
+
+// deliverGroup gives a message that a peer dispatched to this node as a
+// member of a group to one of the local members.
+func (b *Broker) deliverGroup(obj []interface{}) {
+	str, _ := obj[1].(string)
+	data, ok := frame.Bytes(obj[2])
+	name, _ := obj[6].(string)
+	if !ok || name == "" {
+		return
+	}
+	p := &publication{
+		topic:  str,
+		data:   data,
+		remote: true,
+	}
+	p.reply, _ = obj[3].(string)
+	p.publisher, _ = frame.Bytes(obj[4])
+	p.signature, _ = frame.Bytes(obj[5])
+	g := b.lockGroup(groupKey{str, name})
+	b.dispatch(g, p)
+	g.mutex.Unlock()
+}
+
+// addInterest updates the number of local clients subscribed to topic and
+// tells the peers when it changes between zero and non-zero.
+func (b *Broker) addInterest(topic string, delta int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old := b.interest[topic]
+	b.interest[topic] += delta
+	var obj []interface{}
+	if old == 0 && b.interest[topic] > 0 {
+		obj = []interface{}{"s", topic}
+	} else if old > 0 && b.interest[topic] <= 0 {
+		delete(b.interest, topic)
+		obj = []interface{}{"u", topic}
+	} else {
+		return
+	}
+	for l := range b.links {
+		l.send(obj)
+	}
+}
+
+// addGroupInterest updates the number of local members of a group and tells
+// the peers when it changes between zero and non-zero.
+func (b *Broker) addGroupInterest(key groupKey, delta int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old := b.groupInterest[key]
+	b.groupInterest[key] += delta
+	var obj []interface{}
+	if old == 0 && b.groupInterest[key] > 0 {
+		obj = []interface{}{"s", key.topic, key.name}
+	} else if old > 0 && b.groupInterest[key] <= 0 {
+		delete(b.groupInterest, key)
+		obj = []interface{}{"u", key.topic, key.name}
+	} else {
+		return
+	}
+	for l := range b.links {
+		l.send(obj)
+	}
+}
+
+// seenSet remembers the most recent message ids.
+type seenSet struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newSeenSet(size int) *seenSet {
+	return &seenSet{
+		ids:   make(map[string]bool),
+		order: make([]string, size),
+	}
+}
+
+// add returns false if id has been seen before.
+func (ss *seenSet) add(id string) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.ids[id] {
+		return false
+	}
+	delete(ss.ids, ss.order[ss.next])
+	ss.order[ss.next] = id
+	ss.next = (ss.next + 1) % len(ss.order)
+	ss.ids[id] = true
+	return true
+}
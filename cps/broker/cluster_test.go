@@ -0,0 +1,258 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startCluster(t *testing.T, n int) ([]*Broker, []net.Listener) {
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i] = l
+	}
+	nodes := make([]*Broker, n)
+	for i := range nodes {
+		nodes[i] = New(string(rune('a' + i)))
+		nodes[i].PeerSecret = "secret"
+		go nodes[i].Serve(listeners[i])
+		for j := range listeners {
+			if j != i {
+				go nodes[i].Connect(listeners[j].Addr().String())
+			}
+		}
+	}
+	return nodes, listeners
+}
+
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, l net.Listener) *testClient {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn, bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(t *testing.T, obj ...interface{}) {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.conn.Write(append(buf, '\n'))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) recv(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, _, err := c.r.ReadLine()
+	return string(line), err
+}
+
+// peers returns the ids of the nodes that node forwards topic to.
+func peers(node *Broker, topic string) []string {
+	var ids []string
+	node.subscribers(topic, func(c *client) {
+		if c.peer {
+			ids = append(ids, c.id)
+		}
+	})
+	return ids
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterForwarding(t *testing.T) {
+	nodes, listeners := startCluster(t, 3)
+	sub := dial(t, listeners[2])
+	sub.send(t, "s", "t")
+	local := dial(t, listeners[0])
+	local.send(t, "s", "t")
+	waitFor(t, func() bool {
+		return len(peers(nodes[1], "t")) == 2 && len(peers(nodes[0], "t")) == 1
+	})
+	if ids := peers(nodes[0], "t"); ids[0] != "c" {
+		t.Errorf("node a forwards to %v, expected [c]", ids)
+	}
+
+	pub := dial(t, listeners[1])
+	pub.send(t, "p", "t", "aGVsbG8=")
+	for _, c := range []*testClient{sub, local} {
+		line, err := c.recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != `["p","t","aGVsbG8="]` {
+			t.Errorf("received %s", line)
+		}
+		if line, err := c.recv(100 * time.Millisecond); err == nil {
+			t.Errorf("received duplicate %s", line)
+		}
+	}
+
+	sub.send(t, "u", "t")
+	waitFor(t, func() bool {
+		return len(peers(nodes[1], "t")) == 1
+	})
+}
+
+func TestClusterSelfPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	node := New("a")
+	node.PeerSecret = "secret"
+	go node.Serve(l)
+	go node.Connect(l.Addr().String())
+
+	sub := dial(t, l)
+	sub.send(t, "s", "t")
+	waitFor(t, func() bool {
+		return len(peers(node, "t")) == 1
+	})
+	sub.send(t, "p", "t", "aGVsbG8=")
+	if _, err := sub.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := sub.recv(100 * time.Millisecond); err == nil {
+		t.Errorf("received duplicate %s", line)
+	}
+}
+
+func TestClusterSlowPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// A peer that accepts the link but never reads from it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(`["v",1]` + "\n"))
+		<-ctx.Done()
+		conn.Close()
+	}()
+	node := New("a")
+	go node.Connect(l.Addr().String())
+	waitFor(t, func() bool {
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		return len(node.links) == 1
+	})
+
+	// Subscribing tells the peer, which soon stops accepting data
+	c, err := node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	long := strings.Repeat("t", 64<<10)
+	for i := 0; i < 200; i++ {
+		if _, err := c.Subscribe(ctx, fmt.Sprint(long, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.PublishSync(ctx, "t", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// groupPeers returns the number of nodes that node counts as members of a
+// group.
+func groupPeers(node *Broker, topic, name string) int {
+	g := node.group(groupKey{topic, name})
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	n := 0
+	for _, member := range g.members {
+		if member.peer {
+			n++
+		}
+	}
+	return n
+}
+
+func TestClusterGroups(t *testing.T) {
+	nodes, listeners := startCluster(t, 2)
+	// A member on node b only
+	b := dial(t, listeners[1])
+	b.send(t, "s", "t", "g")
+	waitFor(t, func() bool {
+		return groupPeers(nodes[0], "t", "g") == 1
+	})
+	pub := dial(t, listeners[0])
+	pub.send(t, "p", "t", "MQ==")
+	line, err := b.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj []interface{}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil || len(obj) != 8 || obj[2] != "MQ==" {
+		t.Fatalf("received %s", line)
+	}
+	b.send(t, "k", obj[7])
+
+	// With a member on each node, every message is received once
+	a := dial(t, listeners[0])
+	a.send(t, "s", "t", "g")
+	waitFor(t, func() bool {
+		return groupPeers(nodes[1], "t", "g") == 1
+	})
+	const n = 20
+	for i := 0; i < n; i++ {
+		pub.send(t, "p", "t", "Mg==")
+	}
+	other := dial(t, listeners[1])
+	for i := 0; i < n; i++ {
+		other.send(t, "p", "t", "Mw==")
+	}
+	received := 0
+	for _, c := range []*testClient{a, b} {
+		for {
+			line, err := c.recv(200 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			if err := json.Unmarshal([]byte(line), &obj); err != nil || len(obj) != 8 {
+				t.Fatalf("received %s", line)
+			}
+			c.send(t, "k", obj[7])
+			received++
+		}
+	}
+	if received != 2*n {
+		t.Errorf("received %d messages, expected %d", received, 2*n)
+	}
+}
@@ -0,0 +1,256 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+// Subscribers that join a topic with the same group name share the
+// messages of the topic: each message goes to one member, chosen round
+// robin, which acknowledges it with ["k", delivery]. Messages that a member
+// hasn't acknowledged when it leaves are given to another member. Messages
+// that no member can take, because there are none or their queues are full,
+// are kept in a backlog of up to backlogSize messages. The backlog is
+// retried when a member joins, acknowledges a message or catches up with
+// its queue. A group is removed when its last member leaves, unless it has
+// a backlog.
+//
+// In a cluster, only the node a message is published on dispatches it to
+// a group. A node tells its peers about the groups it has members of with
+// ["s", topic, name], so that the peers count it as a member. A message
+// given to a node as a member is sent as ["g", topic, data, reply,
+// publisher, signature, name], and that node gives it to one of its own
+// members. It is acknowledged on sending, as the node takes over.
+
+const backlogSize = 1024
+
+type groupKey struct {
+	topic string
+	name  string
+}
+
+type group struct {
+	key     groupKey
+	mutex   sync.Mutex
+	members []*client
+	next    int
+	pending map[uint64]*delivery
+	backlog []*publication
+	// removed is set once the group is no longer in Broker.groups
+	removed bool
+}
+
+type delivery struct {
+	p      *publication
+	member *client
+}
+
+func (b *Broker) group(key groupKey) *group {
+	b.groupsMutex.Lock()
+	defer b.groupsMutex.Unlock()
+	if b.groups[key.topic] == nil {
+		b.groups[key.topic] = make(map[string]*group)
+	}
+	g, ok := b.groups[key.topic][key.name]
+	if !ok {
+		g = &group{
+			key:     key,
+			pending: make(map[uint64]*delivery),
+		}
+		b.groups[key.topic][key.name] = g
+	}
+	return g
+}
+
+// lockGroup returns the group with the given key, locked.
+func (b *Broker) lockGroup(key groupKey) *group {
+	for {
+		g := b.group(key)
+		g.mutex.Lock()
+		if !g.removed {
+			return g
+		}
+		// The last member left in the meantime
+		g.mutex.Unlock()
+	}
+}
+
+// groupsOf returns the groups of topic.
+func (b *Broker) groupsOf(topic string) []*group {
+	b.groupsMutex.Lock()
+	defer b.groupsMutex.Unlock()
+	groups := make([]*group, 0, len(b.groups[topic]))
+	for _, g := range b.groups[topic] {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func (b *Broker) join(c *client, key groupKey) error {
+	c.mutex.Lock()
+	full := !c.peer && b.Limits.MaxSubscriptions > 0 &&
+		len(c.topics)+len(c.groups) >= b.Limits.MaxSubscriptions && !c.groups[key]
+	joined := c.groups[key]
+	if !full {
+		c.groups[key] = true
+	}
+	c.mutex.Unlock()
+	if full {
+		return ErrTooManySubscriptions
+	}
+	if joined {
+		return nil
+	}
+	g := b.lockGroup(key)
+	g.members = append(g.members, c)
+	b.retry(g)
+	g.mutex.Unlock()
+	if !c.peer {
+		b.addGroupInterest(key, 1)
+	}
+	return nil
+}
+
+func (b *Broker) leave(c *client, key groupKey) {
+	c.mutex.Lock()
+	joined := c.groups[key]
+	delete(c.groups, key)
+	c.mutex.Unlock()
+	if !joined {
+		return
+	}
+	g := b.lockGroup(key)
+	for i, member := range g.members {
+		if member == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	for id, d := range g.pending {
+		if d.member == c {
+			delete(g.pending, id)
+			c.mutex.Lock()
+			delete(c.pending, id)
+			c.mutex.Unlock()
+			b.dispatch(g, d.p)
+		}
+	}
+	if len(g.members) == 0 && len(g.backlog) == 0 {
+		g.removed = true
+		b.groupsMutex.Lock()
+		delete(b.groups[key.topic], key.name)
+		if len(b.groups[key.topic]) == 0 {
+			delete(b.groups, key.topic)
+		}
+		b.groupsMutex.Unlock()
+	}
+	g.mutex.Unlock()
+	if !c.peer {
+		b.addGroupInterest(key, -1)
+	}
+}
+
+// ack marks a delivery to c as done.
+func (b *Broker) ack(c *client, id uint64) {
+	c.mutex.Lock()
+	g := c.pending[id]
+	delete(c.pending, id)
+	c.mutex.Unlock()
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	delete(g.pending, id)
+	// The member has room for another message
+	b.retry(g)
+	g.mutex.Unlock()
+}
+
+// retryGroups retries the backlogs of the groups c is a member of. It is
+// called when c has caught up with its queue after frames were dropped.
+func (b *Broker) retryGroups(c *client) {
+	c.mutex.Lock()
+	keys := make([]groupKey, 0, len(c.groups))
+	for key := range c.groups {
+		keys = append(keys, key)
+	}
+	c.mutex.Unlock()
+	for _, key := range keys {
+		b.groupsMutex.Lock()
+		g := b.groups[key.topic][key.name]
+		b.groupsMutex.Unlock()
+		if g == nil {
+			continue
+		}
+		g.mutex.Lock()
+		b.retry(g)
+		g.mutex.Unlock()
+	}
+}
+
+// retry dispatches the backlog of g again. Messages that still can't be
+// given to a member go back to the backlog in order. g must be locked.
+func (b *Broker) retry(g *group) {
+	if len(g.backlog) == 0 || len(g.members) == 0 {
+		return
+	}
+	backlog := g.backlog
+	g.backlog = nil
+	for _, p := range backlog {
+		b.dispatch(g, p)
+	}
+}
+
+// dispatch gives p to the next member of g that accepts it, or adds it to
+// the backlog. Publications from other nodes only go to local members, so
+// they aren't passed on again. g must be locked.
+func (b *Broker) dispatch(g *group, p *publication) {
+	id := b.deliveries.Add(1)
+	msg := frame.NewEncoded([]interface{}{"p", p.topic, p.data, p.reply, p.publisher, p.signature, g.key.name, id})
+	var fwd *frame.Encoded
+	for range g.members {
+		member := g.members[g.next%len(g.members)]
+		g.next++
+		if member.peer {
+			if p.remote {
+				continue
+			}
+			if fwd == nil {
+				fwd = frame.NewEncoded([]interface{}{"g", p.topic, p.data, p.reply, p.publisher, p.signature, g.key.name})
+			}
+			if member.send(fwd) == nil {
+				b.metrics.forwarded.Add(1)
+				return
+			}
+			continue
+		}
+		member.mutex.Lock()
+		member.pending[id] = g
+		member.mutex.Unlock()
+		if member.send(msg) == nil {
+			g.pending[id] = &delivery{p, member}
+			b.metrics.delivered.Add(1)
+			return
+		}
+		member.mutex.Lock()
+		delete(member.pending, id)
+		member.mutex.Unlock()
+	}
+	if len(g.backlog) >= backlogSize {
+		g.backlog = g.backlog[1:]
+		b.metrics.dropped.Add(1)
+	}
+	g.backlog = append(g.backlog, p)
+}
+
+// deliverGroups gives p to one member of each group of its topic.
+func (b *Broker) deliverGroups(p *publication) {
+	for _, g := range b.groupsOf(p.topic) {
+		g.mutex.Lock()
+		if !g.removed {
+			b.dispatch(g, p)
+		}
+		g.mutex.Unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupBacklog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := New("")
+	pub, err := b.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	conn := b.Pipe()
+	defer conn.Close()
+	worker := &testClient{conn, bufio.NewReader(conn)}
+	worker.send(t, "s", "jobs", "workers", 1)
+	if line, err := worker.recv(time.Second); err != nil || line != `["a",1]` {
+		t.Fatalf("received %s: %v", line, err)
+	}
+
+	// The worker doesn't read, so its queue fills up and the rest of the
+	// jobs go to the backlog
+	const jobs = queueSize + 100
+	for i := 0; i < jobs; i++ {
+		err := pub.PublishSync(ctx, "jobs", []byte("job"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < jobs; i++ {
+		line, err := worker.recv(time.Second)
+		if err != nil {
+			t.Fatalf("received %d jobs: %v", i, err)
+		}
+		if !strings.HasPrefix(line, `["p","jobs"`) {
+			t.Errorf("received %s", line)
+		}
+	}
+}
+
+func TestGroupRemoved(t *testing.T) {
+	b := New("")
+	conn := b.Pipe()
+	defer conn.Close()
+	c := &testClient{conn, bufio.NewReader(conn)}
+	c.send(t, "s", "jobs", "workers", 1)
+	if line, err := c.recv(time.Second); err != nil || line != `["a",1]` {
+		t.Fatalf("received %s: %v", line, err)
+	}
+	c.send(t, "u", "jobs", "workers")
+	waitFor(t, func() bool {
+		b.groupsMutex.Lock()
+		defer b.groupsMutex.Unlock()
+		return len(b.groups) == 0
+	})
+}
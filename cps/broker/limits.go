@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+// Limits restrict what a single connection may do. Zero values mean no
+// limit. Connections from other cluster nodes are not limited.
+type Limits struct {
+	// Publications per connection
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+
+	// Publications per topic, summed over all connections
+	TopicMessagesPerSecond float64
+	TopicBytesPerSecond    float64
+
+	MaxSubscriptions int
+	MaxPayload       int
+}
+
+var (
+	ErrPayloadTooLarge      = errors.New("payload too large")
+	ErrMessageRate          = errors.New("message rate limit exceeded")
+	ErrByteRate             = errors.New("byte rate limit exceeded")
+	ErrTopicMessageRate     = errors.New("topic message rate limit exceeded")
+	ErrTopicByteRate        = errors.New("topic byte rate limit exceeded")
+	ErrTooManySubscriptions = errors.New("subscription limit exceeded")
+)
+
+// bucket is a token bucket that holds at most one second worth of tokens.
+// Takes larger than the rate are allowed when the bucket is full and
+// overdraw it, so the next ones have to wait until the debt is paid.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+func (b *bucket) take(n float64, now time.Time) bool {
+	b.refill(now)
+	if b.tokens < math.Min(n, b.rate) {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// limiter holds the buckets of a connection or topic.
+type limiter struct {
+	msgs  *bucket
+	bytes *bucket
+}
+
+func newLimiter(msgs, bytes float64, now time.Time) *limiter {
+	l := &limiter{}
+	if msgs > 0 {
+		l.msgs = newBucket(msgs, now)
+	}
+	if bytes > 0 {
+		l.bytes = newBucket(bytes, now)
+	}
+	return l
+}
+
+func (l *limiter) admit(size int, now time.Time, errMsgs, errBytes error) error {
+	if l.msgs != nil && !l.msgs.take(1, now) {
+		return errMsgs
+	}
+	if l.bytes != nil && !l.bytes.take(float64(size), now) {
+		return errBytes
+	}
+	return nil
+}
+
+func (l *limiter) idle(now time.Time) bool {
+	for _, b := range []*bucket{l.msgs, l.bytes} {
+		if b != nil {
+			b.refill(now)
+			if b.tokens < b.rate {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// topicLimiters holds the limiters of the topics that have been published
+// to recently.
+type topicLimiters struct {
+	mutex sync.Mutex
+	m     map[string]*limiter
+	sweep int
+}
+
+func (t *topicLimiters) admit(limits *Limits, topic string, size int, now time.Time) error {
+	if limits.TopicMessagesPerSecond <= 0 && limits.TopicBytesPerSecond <= 0 {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.m == nil {
+		t.m = make(map[string]*limiter)
+	}
+	l, ok := t.m[topic]
+	if !ok {
+		if len(t.m) >= t.sweep {
+			// Forget topics whose buckets are full again
+			for topic, l := range t.m {
+				if l.idle(now) {
+					delete(t.m, topic)
+				}
+			}
+			t.sweep = 2*len(t.m) + 1024
+		}
+		l = newLimiter(limits.TopicMessagesPerSecond, limits.TopicBytesPerSecond, now)
+		t.m[topic] = l
+	}
+	return l.admit(size, now, ErrTopicMessageRate, ErrTopicByteRate)
+}
+
+// frameOverhead is what a frame may hold besides its payload: the topic, the
+// reply topic, the publisher's key and signature and the ids.
+const frameOverhead = 64 << 10
+
+// frameLimit returns the largest frame read from a connection. It leaves
+// room for base64 encoded payloads in JSON frames.
+func (b *Broker) frameLimit() int {
+	if b.Limits.MaxPayload <= 0 || b.Limits.MaxPayload > frame.MaxSize {
+		return frame.MaxSize
+	}
+	return (b.Limits.MaxPayload+2)/3*4 + frameOverhead
+}
+
+// admit checks whether client c may publish size bytes on topic.
+func (b *Broker) admit(c *client, topic string, size int) error {
+	if c.peer {
+		return nil
+	}
+	if b.Limits.MaxPayload > 0 && size > b.Limits.MaxPayload {
+		return ErrPayloadTooLarge
+	}
+	now := time.Now()
+	if c.limiter == nil {
+		c.limiter = newLimiter(b.Limits.MessagesPerSecond, b.Limits.BytesPerSecond, now)
+	}
+	err := c.limiter.admit(size, now, ErrMessageRate, ErrByteRate)
+	if err != nil {
+		return err
+	}
+	return b.topicLimiters.admit(&b.Limits, topic, size, now)
+}
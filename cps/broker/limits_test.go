@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(2, now)
+	if !b.take(1, now) || !b.take(1, now) {
+		t.Fatal("bucket starts empty")
+	}
+	if b.take(1, now) {
+		t.Fatal("bucket allows more than the rate")
+	}
+	if b.take(10, now.Add(time.Second/2)) {
+		t.Fatal("large take allowed before the bucket is full")
+	}
+	if !b.take(10, now.Add(time.Second)) {
+		t.Fatal("bucket doesn't refill")
+	}
+	if b.take(1, now.Add(2*time.Second)) {
+		t.Fatal("overdrawn bucket allows more")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := New("a")
+	b.Limits = Limits{
+		MessagesPerSecond: 1,
+		MaxSubscriptions:  1,
+		MaxPayload:        5,
+	}
+	go b.Serve(l)
+
+	c := dial(t, l)
+	c.send(t, "p", "t", "aGVsbG8gd29ybGQ=", "", 1)
+	c.send(t, "p", "t", "aGVsbG8=", "", 2)
+	c.send(t, "p", "t", "aGVsbG8=", "", 3)
+	c.send(t, "s", "t")
+	c.send(t, "s", "u")
+	for _, expected := range []string{
+		`["e",1,"payload too large"]`,
+		`["a",2]`,
+		`["e",3,"message rate limit exceeded"]`,
+		`["e",null,"subscription limit exceeded"]`,
+	} {
+		line, err := c.recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("received %s, expected %s", line, expected)
+		}
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := New("a")
+	b.Limits = Limits{MaxPayload: 5}
+	go b.Serve(l)
+
+	// Frames far beyond the payload limit aren't even read
+	c := dial(t, l)
+	line := `["p","t","` + strings.Repeat("A", 1<<20) + `"]` + "\n"
+	go c.conn.Write([]byte(line))
+	_, err = c.recv(time.Second)
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("%v, expected the connection to be closed", err)
+	}
+}
+
+func TestFakePeerHello(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := New("a")
+	b.PeerSecret = "secret"
+	b.Limits = Limits{MaxPayload: 1}
+	go b.Serve(l)
+
+	for _, hello := range [][]interface{}{
+		{"h", "peer", "x"},
+		{"h", "peer", "x", "guess"},
+	} {
+		c := dial(t, l)
+		c.send(t, hello...)
+		c.send(t, "p", "t", "aGVsbG8=", "", 1)
+		line, err := c.recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `["e",1,"payload too large"]`; line != expected {
+			t.Errorf("after %v received %s, expected %s", hello, line, expected)
+		}
+	}
+
+	c := dial(t, l)
+	c.send(t, "h", "peer", "x", "secret")
+	c.send(t, "p", "t", "aGVsbG8=", "", 1)
+	line, err := c.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `["a",1]`; line != expected {
+		t.Errorf("peer received %s, expected %s", line, expected)
+	}
+}
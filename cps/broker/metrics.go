@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+type metrics struct {
+	connections atomic.Int64
+	published   atomic.Uint64
+	delivered   atomic.Uint64
+	forwarded   atomic.Uint64
+	dropped     atomic.Uint64
+	limited     atomic.Uint64
+	halfOpen    atomic.Uint64
+	writes      histogram
+}
+
+var writeBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	mutex  sync.Mutex
+	counts [11]uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := sort.SearchFloat64s(writeBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var n uint64
+	for i, le := range writeBuckets {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// AdminHandler serves the metrics in the Prometheus text format on
+// /metrics, and lists the topics and clients as JSON on /topics and
+// /clients.
+func (b *Broker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", b.serveMetrics)
+	mux.HandleFunc("/topics", b.serveTopics)
+	mux.HandleFunc("/clients", b.serveClients)
+	return mux
+}
+
+func (b *Broker) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := &b.metrics
+
+	metric(w, "cps_connections", "gauge", "Number of open connections.")
+	fmt.Fprintf(w, "cps_connections %d\n", m.connections.Load())
+	metric(w, "cps_topics", "gauge", "Number of topics with subscribers.")
+	topics := b.topics()
+	fmt.Fprintf(w, "cps_topics %d\n", len(topics))
+	metric(w, "cps_subscriptions", "gauge", "Number of subscribers per topic.")
+	for _, t := range topics {
+		fmt.Fprintf(w, "cps_subscriptions{topic=\"%s\"} %d\n", labelEscaper.Replace(t.Topic), t.Subscribers)
+	}
+	metric(w, "cps_published_total", "counter", "Messages published by clients of this node.")
+	fmt.Fprintf(w, "cps_published_total %d\n", m.published.Load())
+	metric(w, "cps_delivered_total", "counter", "Messages queued for delivery to clients.")
+	fmt.Fprintf(w, "cps_delivered_total %d\n", m.delivered.Load())
+	metric(w, "cps_forwarded_total", "counter", "Messages forwarded to other cluster nodes.")
+	fmt.Fprintf(w, "cps_forwarded_total %d\n", m.forwarded.Load())
+	metric(w, "cps_dropped_total", "counter", "Frames dropped because a connection didn't keep up.")
+	fmt.Fprintf(w, "cps_dropped_total %d\n", m.dropped.Load())
+	metric(w, "cps_limited_total", "counter", "Frames rejected because a limit was hit.")
+	fmt.Fprintf(w, "cps_limited_total %d\n", m.limited.Load())
+	metric(w, "cps_half_open_total", "counter", "Connections closed because the other end stopped answering pings.")
+	fmt.Fprintf(w, "cps_half_open_total %d\n", m.halfOpen.Load())
+	metric(w, "cps_write_seconds", "histogram", "Time spent writing frames to connections.")
+	m.writes.write(w, "cps_write_seconds")
+}
+
+type topicInfo struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+	Peers       int    `json:"peers"`
+}
+
+// topics returns the topics that have subscribers, sorted by name.
+func (b *Broker) topics() []topicInfo {
+	var topics []topicInfo
+	b.subscriptions.Range(func(key interface{}, value interface{}) bool {
+		t := topicInfo{Topic: key.(string)}
+		value.(*sync.Map).Range(func(key interface{}, value interface{}) bool {
+			if key.(*client).peer {
+				t.Peers++
+			} else {
+				t.Subscribers++
+			}
+			return true
+		})
+		if t.Subscribers+t.Peers > 0 {
+			topics = append(topics, t)
+		}
+		return true
+	})
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Topic < topics[j].Topic
+	})
+	return topics
+}
+
+func (b *Broker) serveTopics(w http.ResponseWriter, r *http.Request) {
+	topics := b.topics()
+	if topics == nil {
+		topics = []topicInfo{}
+	}
+	writeJSON(w, topics)
+}
+
+type clientInfo struct {
+	Addr   string    `json:"addr"`
+	Peer   string    `json:"peer,omitempty"`
+	Format string    `json:"format"`
+	Since  time.Time `json:"since"`
+	Queued int       `json:"queued"`
+	Topics []string  `json:"topics"`
+}
+
+func (b *Broker) serveClients(w http.ResponseWriter, r *http.Request) {
+	clients := []clientInfo{}
+	b.clients.Range(func(key interface{}, value interface{}) bool {
+		c := key.(*client)
+		info := clientInfo{
+			Addr:   c.conn.RemoteAddr().String(),
+			Format: "json",
+			Since:  c.since,
+			Queued: len(c.queue),
+			Topics: []string{},
+		}
+		c.mutex.Lock()
+		if c.peer {
+			info.Peer = c.id
+		}
+		if c.format == frame.Binary {
+			info.Format = "binary"
+		}
+		for topic := range c.topics {
+			info.Topics = append(info.Topics, topic)
+		}
+		c.mutex.Unlock()
+		sort.Strings(info.Topics)
+		clients = append(clients, info)
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Since.Before(clients[j].Since)
+	})
+	writeJSON(w, clients)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	srv := New("a")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+	hs := httptest.NewServer(srv.AdminHandler())
+	defer hs.Close()
+
+	sub := dial(t, l)
+	sub.send(t, "s", "t")
+	time.Sleep(50 * time.Millisecond)
+	sub.send(t, "p", "t", "aGVsbG8=")
+	if _, err := sub.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := hs.Client().Get(hs.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		"cps_connections 1",
+		`cps_subscriptions{topic="t"} 1`,
+		"cps_published_total 1",
+		"cps_delivered_total 1",
+		"cps_write_seconds_count 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+
+	resp, err = hs.Client().Get(hs.URL + "/topics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []topicInfo
+	err = json.NewDecoder(resp.Body).Decode(&topics)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0].Topic != "t" || topics[0].Subscribers != 1 {
+		t.Errorf("topics %v", topics)
+	}
+
+	resp, err = hs.Client().Get(hs.URL + "/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []clientInfo
+	err = json.NewDecoder(resp.Body).Decode(&clients)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || len(clients[0].Topics) != 1 {
+		t.Errorf("clients %v", clients)
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+	"github.com/jakobvarmose/everything/cps/store"
+)
+
+var ErrNotPersisted = errors.New("topic not persisted")
+
+// historyLimit is the largest number of stored messages sent for one
+// history request, which keeps them from overflowing the client's queue.
+const historyLimit = 100
+
+// retentionInterval is how often the retention of the persisted topics is
+// enforced.
+var retentionInterval = time.Minute
+
+// Persist stores the publications on topic in Store, from where clients can
+// read them back, and discards them as r allows. The node asks the other
+// nodes of the cluster to forward the topic to it, so it stores the
+// publications made anywhere in the cluster.
+func (b *Broker) Persist(topic string, r store.Retention) {
+	b.mutex.Lock()
+	if b.Store == nil {
+		b.Store = store.NewMemory()
+	}
+	_, ok := b.persisted[topic]
+	b.persisted[topic] = r
+	start := !ok && len(b.persisted) == 1
+	b.mutex.Unlock()
+	if !ok {
+		b.addInterest(topic, 1)
+	}
+	if start {
+		go b.enforceRetention()
+	}
+}
+
+// store appends a publication to the store. Stored records hold the
+// MessagePack encoding of the data, reply topic, publisher and signature.
+func (b *Broker) store(p *publication) {
+	buf, err := frame.Marshal([]interface{}{p.data, p.reply, p.publisher, p.signature})
+	if err == nil {
+		_, err = b.Store.Append(p.topic, buf, time.Now())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+// history sends the stored messages of topic from sequence number from as
+// message frames tagged with id.
+func (b *Broker) history(c *client, topic string, from, max uint64, id interface{}) error {
+	b.mutex.Lock()
+	_, ok := b.persisted[topic]
+	b.mutex.Unlock()
+	if !ok {
+		return ErrNotPersisted
+	}
+	if max > historyLimit {
+		max = historyLimit
+	}
+	records, err := b.Store.Read(topic, from, int(max))
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		v, err := frame.Unmarshal(rec.Data)
+		obj, _ := v.([]interface{})
+		if err != nil || len(obj) < 4 {
+			continue
+		}
+		err = c.send(frame.NewEncoded([]interface{}{
+			"m", id, rec.Seq, rec.Time.UnixNano(), topic, obj[0], obj[1], obj[2], obj[3],
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) enforceRetention() {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			b.sweep(now)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// sweep discards the stored messages that are past their retention.
+func (b *Broker) sweep(now time.Time) {
+	b.mutex.Lock()
+	persisted := make(map[string]store.Retention, len(b.persisted))
+	for topic, r := range b.persisted {
+		persisted[topic] = r
+	}
+	b.mutex.Unlock()
+	for topic, r := range persisted {
+		err := r.Enforce(b.Store, topic, now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+}
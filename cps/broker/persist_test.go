@@ -0,0 +1,36 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/store"
+)
+
+func TestClusterPersist(t *testing.T) {
+	nodes, listeners := startCluster(t, 2)
+	nodes[1].Persist("t", store.Retention{MaxAge: time.Hour})
+	waitFor(t, func() bool {
+		return len(peers(nodes[0], "t")) == 1
+	})
+
+	// Published on the other node
+	pub := dial(t, listeners[0])
+	pub.send(t, "p", "t", "aGVsbG8=", "", 1)
+	if _, err := pub.recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		info, _ := nodes[1].Store.Info("t")
+		return info.Next == 2
+	})
+
+	nodes[1].sweep(time.Now())
+	if info, _ := nodes[1].Store.Info("t"); info.First != 1 {
+		t.Errorf("info %+v, expected the message to be kept", info)
+	}
+	nodes[1].sweep(time.Now().Add(2 * time.Hour))
+	if info, _ := nodes[1].Store.Info("t"); info.First != 2 {
+		t.Errorf("info %+v, expected the message to be discarded", info)
+	}
+}
@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"bytes"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn turns the messages of a WebSocket connection into JSON lines.
+// Every message received must hold a single frame, and every frame sent is
+// a separate text message.
+type wsConn struct {
+	*websocket.Conn
+	buf []byte
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		var msg []byte
+		err := websocket.Message.Receive(c.Conn, &msg)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = append(bytes.TrimRight(msg, "\r\n"), '\n')
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// WebSocketHandler accepts browser clients. They share the topics with the
+// TCP clients but always use JSON frames.
+func (b *Broker) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handler: func(conn *websocket.Conn) {
+			b.handle(&wsConn{Conn: conn}, false)
+		},
+	}
+}
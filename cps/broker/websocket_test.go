@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	srv := New("a")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+	hs := httptest.NewServer(srv.WebSocketHandler())
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	ws, err := websocket.Dial(url, "", hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	err = websocket.Message.Send(ws, `["s","t"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	pub := dial(t, l)
+	pub.send(t, "p", "t", "aGVsbG8=")
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var msg string
+	err = websocket.Message.Receive(ws, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(msg) != `["p","t","aGVsbG8="]` {
+		t.Errorf("received %s", msg)
+	}
+
+	sub := dial(t, l)
+	sub.send(t, "s", "u")
+	time.Sleep(50 * time.Millisecond)
+	err = websocket.Message.Send(ws, `["p","u","aGVsbG8=","",1]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := sub.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != `["p","u","aGVsbG8="]` {
+		t.Errorf("received %s", line)
+	}
+	err = websocket.Message.Receive(ws, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(msg) != `["a",1]` {
+		t.Errorf("received %s, expected ack", msg)
+	}
+}
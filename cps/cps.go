@@ -1,126 +1,714 @@
 package cps
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/frame"
 )
 
 var serverAddress = "crypta.io:8707"
 
+var (
+	ErrClosed   = errors.New("connection closed")
+	ErrShutdown = errors.New("server shutting down")
+	ErrTimeout  = errors.New("server stopped responding")
+	ErrCanceled = errors.New("subscription canceled")
+)
+
+// handshakeTimeout is how long New waits for the server to agree to binary
+// frames before falling back to JSON.
+var handshakeTimeout = 2 * time.Second
+
 // CPS (Centralized PubSub)
 type CPS struct {
-	conn   net.Conn
+	dial      func() (net.Conn, error)
+	keepAlive time.Duration
+
+	connMutex sync.Mutex
+	conn      net.Conn
+	format    frame.Format
+
 	mutex  sync.Mutex
 	topics map[string][]*Subscription
+	nextID uint64
+	acks   map[uint64]chan error
+	// history collects the messages returned for History requests
+	history map[uint64][]*Message
+	done    chan struct{}
+	err     error
 }
 
 type Subscription struct {
 	c     *CPS
-	ch    chan []byte
+	ch    chan *Message
+	done  chan struct{}
+	once  sync.Once
 	topic string
+	opts  options
+
+	outOnce sync.Once
+	out     chan Message
+}
+
+// Message is a publication received on a subscription. Reply is set when
+// the publisher expects an answer, see Request. Publisher is the key the
+// message claims to be signed with, and Verified is set if the signature
+// is valid. Seq and Time are only set for messages returned by History.
+type Message struct {
+	Topic     string
+	Data      []byte
+	Reply     string
+	Publisher ed25519.PublicKey
+	Verified  bool
+	Seq       uint64
+	Time      time.Time
+
+	c        *CPS
+	group    string
+	delivery uint64
+}
+
+// Ack tells the server that a message received through a group has been
+// handled. Messages that aren't acknowledged when the subscription ends are
+// given to another member of the group. Ack does nothing for other
+// messages.
+func (m *Message) Ack() error {
+	if m.delivery == 0 {
+		return nil
+	}
+	return m.c.send([]interface{}{"k", m.delivery})
+}
+
+// New connects to the server. The client pings the server regularly, see
+// KeepAlive, and reconnects if it stops answering, says goodbye or the
+// connection fails.
+func New(opts ...DialOption) (*CPS, error) {
+	o := newDialOptions(opts)
+	if o.dial == nil {
+		address := o.address
+		o.dial = func() (net.Conn, error) {
+			return net.Dial("tcp", address)
+		}
+	}
+	conn, err := o.dial()
+	if err != nil {
+		return nil, err
+	}
+	return newCPS(conn, o)
+}
+
+// NewConn returns a client that talks to a server over conn. Unless the
+// Dialer option is given, the client can't reconnect and fails when the
+// connection ends, see Err.
+func NewConn(conn net.Conn, opts ...DialOption) (*CPS, error) {
+	return newCPS(conn, newDialOptions(opts))
 }
 
-func New() (*CPS, error) {
-	conn, err := net.Dial("tcp", serverAddress)
+func newCPS(conn net.Conn, o dialOptions) (*CPS, error) {
+	r := frame.NewReader(conn)
+	format, err := frame.Negotiate(conn, r, handshakeTimeout)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	c := &CPS{
-		conn:   conn,
-		topics: make(map[string][]*Subscription),
-	}
-	go func() {
-		r := bufio.NewReader(conn)
-		for {
-			line, _, err := r.ReadLine()
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			var obj []interface{}
-			err = json.Unmarshal(line, &obj)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
+		conn:      conn,
+		format:    format,
+		dial:      o.dial,
+		keepAlive: o.keepAlive,
+		topics:    make(map[string][]*Subscription),
+		acks:      make(map[uint64]chan error),
+		history:   make(map[uint64][]*Message),
+		done:      make(chan struct{}),
+	}
+	go c.run(conn, r)
+	if c.keepAlive > 0 {
+		go c.ping()
+	}
+	return c, nil
+}
+
+// run reads frames until the connection ends. Unless the client was closed,
+// the connection is replaced if the client knows how to dial a new one,
+// whether the server stopped responding, said goodbye or went away.
+func (c *CPS) run(conn net.Conn, r *frame.Reader) {
+	for {
+		err := c.read(conn, r)
+		conn.Close()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ErrTimeout
+		}
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if c.dial == nil {
+			c.fail(err)
+			return
+		}
+		// Synchronous publications may or may not have arrived
+		c.failAcks(err)
+		conn, r, err = c.reconnect()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// read handles the frames received on conn. It returns ErrShutdown if the
+// server says goodbye.
+func (c *CPS) read(conn net.Conn, r *frame.Reader) error {
+	for {
+		if c.keepAlive > 0 && r.Format == frame.Binary {
+			conn.SetReadDeadline(time.Now().Add(2 * c.keepAlive))
+		}
+		obj, err := r.Read()
+		if errors.Is(err, frame.ErrMalformed) {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(obj) < 1 {
+			continue
+		}
+		switch obj[0] {
+		case "p":
+			msg := c.message(obj[1:])
+			if msg == nil {
 				continue
 			}
-			if len(obj) < 1 {
-				continue
+			if len(obj) >= 8 {
+				msg.group, _ = obj[6].(string)
+				msg.delivery, _ = frame.Uint(obj[7])
 			}
-			switch obj[0] {
-			case "p":
-				if len(obj) < 3 {
-					continue
+			c.mutex.Lock()
+			var subs []*Subscription
+			for _, sub := range c.topics[msg.Topic] {
+				if sub.opts.group == msg.group {
+					subs = append(subs, sub)
 				}
-				str, _ := obj[1].(string)
-				dataStr, _ := obj[2].(string)
-				data, err := base64.StdEncoding.DecodeString(dataStr)
-				if err != nil {
+			}
+			if msg.group != "" && len(subs) > 0 {
+				// Only one member of a group gets the message
+				subs = subs[msg.delivery%uint64(len(subs)):][:1]
+			}
+			for _, sub := range subs {
+				m, ok := sub.opts.decode(msg)
+				if !ok {
+					// Don't let the group redeliver it
+					msg.Ack()
 					continue
 				}
-				c.mutex.Lock()
-				for _, sub := range c.topics[str] {
-					go func() {
-						sub.ch <- data
-					}()
-				}
-				c.mutex.Unlock()
+				go func() {
+					select {
+					case sub.ch <- m:
+					case <-sub.done:
+					case <-c.done:
+					}
+				}()
 			}
+			c.mutex.Unlock()
+		case "m":
+			// A stored message, see History
+			if len(obj) < 6 {
+				continue
+			}
+			id, _ := frame.Uint(obj[1])
+			msg := c.message(obj[4:])
+			if msg == nil {
+				continue
+			}
+			msg.Seq, _ = frame.Uint(obj[2])
+			t, _ := frame.Uint(obj[3])
+			msg.Time = time.Unix(0, int64(t))
+			c.mutex.Lock()
+			if h, ok := c.history[id]; ok {
+				c.history[id] = append(h, msg)
+			}
+			c.mutex.Unlock()
+		case "a":
+			if len(obj) < 2 {
+				continue
+			}
+			id, _ := frame.Uint(obj[1])
+			c.ack(id, nil)
+		case "e":
+			if len(obj) < 3 {
+				continue
+			}
+			id, _ := frame.Uint(obj[1])
+			str, _ := obj[2].(string)
+			if !c.ack(id, errors.New(str)) {
+				fmt.Fprintln(os.Stderr, str)
+			}
+		case "i":
+			c.send([]interface{}{"o"})
+		case "x":
+			// The server is going away
+			return ErrShutdown
 		}
-	}()
-	return c, nil
+	}
+}
+
+// message parses the topic, data, reply topic, publisher and signature
+// that start obj. It returns nil if they are invalid.
+func (c *CPS) message(obj []interface{}) *Message {
+	if len(obj) < 2 {
+		return nil
+	}
+	str, _ := obj[0].(string)
+	data, ok := frame.Bytes(obj[1])
+	if !ok {
+		return nil
+	}
+	msg := &Message{
+		Topic: str,
+		Data:  data,
+		c:     c,
+	}
+	if len(obj) >= 3 {
+		msg.Reply, _ = obj[2].(string)
+	}
+	if len(obj) >= 5 {
+		publisher, _ := frame.Bytes(obj[3])
+		signature, _ := frame.Bytes(obj[4])
+		if len(publisher) == ed25519.PublicKeySize {
+			msg.Publisher = publisher
+			msg.Verified = ed25519.Verify(publisher, signedData(str, msg.Reply, data), signature)
+		}
+	}
+	return msg
+}
+
+// ping sends a ping every keepAlive interval until the client is closed.
+// Any frame the server sends in return pushes the read deadline forward.
+// Servers that only speak JSON don't answer pings, so they aren't sent any.
+func (c *CPS) ping() {
+	t := time.NewTicker(c.keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.connMutex.Lock()
+			format := c.format
+			c.connMutex.Unlock()
+			if format == frame.Binary {
+				c.send([]interface{}{"i"})
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// reconnect dials until it gets a new connection, waiting longer after
+// every failure, and subscribes again to the topics of the subscriptions.
+// It only fails if the client is closed.
+func (c *CPS) reconnect() (net.Conn, *frame.Reader, error) {
+	wait := 100 * time.Millisecond
+	for {
+		conn, r, err := c.redial()
+		if err == nil {
+			return conn, r, nil
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return nil, nil, c.Err()
+		}
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
 }
 
-func (c *CPS) Subscribe(topic string) (*Subscription, error) {
-	buf, err := json.Marshal([]interface{}{"s", topic})
+func (c *CPS) redial() (net.Conn, *frame.Reader, error) {
+	conn, err := c.dial()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	_, err = c.conn.Write(append(buf, '\n'))
+	r := frame.NewReader(conn)
+	format, err := frame.Negotiate(conn, r, handshakeTimeout)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
+	}
+	c.connMutex.Lock()
+	c.conn = conn
+	c.format = format
+	c.connMutex.Unlock()
+
+	c.mutex.Lock()
+	var subscribe [][]interface{}
+	for topic, subs := range c.topics {
+		groups := map[string]bool{}
+		for _, sub := range subs {
+			if !groups[sub.opts.group] {
+				groups[sub.opts.group] = true
+				obj := []interface{}{"s", topic}
+				if sub.opts.group != "" {
+					obj = append(obj, sub.opts.group)
+				}
+				subscribe = append(subscribe, obj)
+			}
+		}
+	}
+	c.mutex.Unlock()
+	for _, obj := range subscribe {
+		err = c.send(obj)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	select {
+	case <-c.done:
+		// Closed while reconnecting
+		conn.Close()
+		return nil, nil, c.Err()
+	default:
+	}
+	return conn, r, nil
+}
+
+func (c *CPS) send(obj []interface{}) error {
+	c.connMutex.Lock()
+	conn, format := c.conn, c.format
+	c.connMutex.Unlock()
+	buf, err := frame.Encode(format, obj)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// ack completes the synchronous publication with the given id. It returns
+// false if there is none.
+func (c *CPS) ack(id uint64, err error) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch, ok := c.acks[id]
+	if ok {
+		ch <- err
+		delete(c.acks, id)
+	}
+	return ok
+}
+
+// fail records why the connection ended. Only the first reason is kept.
+func (c *CPS) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.failAcksLocked(err)
+}
+
+// failAcks completes all pending synchronous publications with err.
+func (c *CPS) failAcks(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.failAcksLocked(err)
+}
+
+func (c *CPS) failAcksLocked(err error) {
+	for id, ch := range c.acks {
+		ch <- err
+		delete(c.acks, id)
+	}
+}
+
+// Close tells the server that the client is leaving and closes the
+// connection.
+func (c *CPS) Close() error {
+	c.send([]interface{}{"x"})
+	c.fail(ErrClosed)
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.conn.Close()
+}
+
+// Done returns a channel that is closed when the connection has ended.
+func (c *CPS) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, or nil while it is open. Unless the
+// client can reconnect, it is ErrShutdown if the server asked the client to
+// reconnect elsewhere, ErrTimeout if the server stopped answering pings, and
+// the read error if the connection failed otherwise.
+func (c *CPS) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Subscribe starts receiving the messages published on topic. The
+// subscription is canceled when ctx is done. It fails if the server refuses
+// the subscription, for instance because the client has too many.
+func (c *CPS) Subscribe(ctx context.Context, topic string, opts ...Option) (*Subscription, error) {
+	o := newOptions(opts)
+	obj := []interface{}{"s", topic}
+	if o.group != "" {
+		obj = append(obj, o.group)
 	}
 	s := &Subscription{
 		c:     c,
-		ch:    make(chan []byte),
+		ch:    make(chan *Message),
+		done:  make(chan struct{}),
 		topic: topic,
+		opts:  o,
 	}
+	// Registered first, as a group may deliver its backlog right away
 	s.c.mutex.Lock()
 	c.topics[topic] = append(c.topics[topic], s)
 	s.c.mutex.Unlock()
+	c.connMutex.Lock()
+	format := c.format
+	c.connMutex.Unlock()
+	var err error
+	if format == frame.Binary {
+		// Servers that speak binary frames acknowledge subscriptions, so
+		// that those over the limit fail
+		if o.group == "" {
+			obj = append(obj, "")
+		}
+		err = c.sendSync(ctx, func(id uint64) ([]interface{}, error) {
+			return append(obj, id), nil
+		})
+	} else {
+		err = c.send(obj)
+	}
+	if err != nil {
+		s.Cancel()
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Cancel()
+			case <-s.done:
+			case <-c.done:
+			}
+		}()
+	}
 	return s, nil
 }
 
-func (c *CPS) Publish(topic string, data []byte) error {
-	buf, err := json.Marshal([]interface{}{"p", topic,
-		base64.StdEncoding.EncodeToString(data),
+func (c *CPS) Publish(topic string, data []byte, opts ...Option) error {
+	o := newOptions(opts)
+	obj, err := o.publication(topic, data, "", nil)
+	if err != nil {
+		return err
+	}
+	return c.send(obj)
+}
+
+// PublishSync publishes data and waits until the server has acknowledged
+// the message.
+func (c *CPS) PublishSync(ctx context.Context, topic string, data []byte, opts ...Option) error {
+	return c.publishSync(ctx, topic, data, "", newOptions(opts))
+}
+
+func (c *CPS) publishSync(ctx context.Context, topic string, data []byte, reply string, o options) error {
+	return c.sendSync(ctx, func(id uint64) ([]interface{}, error) {
+		return o.publication(topic, data, reply, id)
 	})
+}
+
+// sendSync sends the frame that build returns for a new id, and waits until
+// the server acknowledges the id.
+func (c *CPS) sendSync(ctx context.Context, build func(id uint64) ([]interface{}, error)) error {
+	ch := make(chan error, 1)
+	c.mutex.Lock()
+	c.nextID++
+	id := c.nextID
+	c.acks[id] = ch
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.acks, id)
+		c.mutex.Unlock()
+	}()
+	obj, err := build(id)
 	if err != nil {
 		return err
 	}
-	_, err = c.conn.Write(append(buf, '\n'))
-	return err
+	err = c.send(obj)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Request publishes data on topic and waits for the first reply. Replies
+// are delivered to an automatically generated inbox topic. The options
+// apply to both the request and the reply.
+func (c *CPS) Request(ctx context.Context, topic string, data []byte, opts ...Option) ([]byte, error) {
+	inbox, err := newInbox()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := c.Subscribe(ctx, inbox, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Cancel()
+	err = c.publishSync(ctx, topic, data, inbox, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+// History returns up to max of the messages stored for a topic the server
+// persists, starting with sequence number from, or with the oldest one if
+// that has been discarded. The server returns at most 100 messages per
+// call. The options apply as they would to a subscription.
+func (c *CPS) History(ctx context.Context, topic string, from uint64, max int, opts ...Option) ([]*Message, error) {
+	o := newOptions(opts)
+	ch := make(chan error, 1)
+	c.mutex.Lock()
+	c.nextID++
+	id := c.nextID
+	c.acks[id] = ch
+	c.history[id] = nil
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.acks, id)
+		delete(c.history, id)
+		c.mutex.Unlock()
+	}()
+	err := c.send([]interface{}{"r", topic, from, max, id})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case err = <-ch:
+	case <-c.done:
+		err = c.Err()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	history := c.history[id]
+	c.mutex.Unlock()
+	var msgs []*Message
+	for _, msg := range history {
+		if m, ok := o.decode(msg); ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// Respond publishes data on the reply topic of msg.
+func (c *CPS) Respond(msg *Message, data []byte, opts ...Option) error {
+	if msg.Reply == "" {
+		return errors.New("message has no reply topic")
+	}
+	return c.Publish(msg.Reply, data, opts...)
+}
+
+func newInbox() (string, error) {
+	var buf [12]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return "_INBOX." + hex.EncodeToString(buf[:]), nil
 }
 
 func (s *Subscription) Topic() string {
 	return s.topic
 }
 
-func (s *Subscription) Next(ctx context.Context) ([]byte, error) {
+// Next waits for the next message. It fails with ErrCanceled once the
+// subscription has been canceled.
+func (s *Subscription) Next(ctx context.Context) (*Message, error) {
 	select {
-	case data := <-s.ch:
-		return data, nil
+	case msg := <-s.ch:
+		return msg, nil
+	case <-s.done:
+		return nil, ErrCanceled
+	case <-s.c.done:
+		return nil, s.c.Err()
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
+// C returns a channel that receives the messages, for use in select
+// statements. It is closed when the subscription is canceled or the
+// connection ends. Messages are handed out either by C or by Next, so the
+// two shouldn't be mixed.
+func (s *Subscription) C() <-chan Message {
+	s.outOnce.Do(func() {
+		s.out = make(chan Message)
+		go func() {
+			defer close(s.out)
+			for {
+				select {
+				case msg := <-s.ch:
+					select {
+					case s.out <- *msg:
+					case <-s.done:
+						return
+					case <-s.c.done:
+						return
+					}
+				case <-s.done:
+					return
+				case <-s.c.done:
+					return
+				}
+			}
+		}()
+	})
+	return s.out
+}
+
+// Cancel ends the subscription. It may be called more than once.
 func (s *Subscription) Cancel() {
+	s.once.Do(s.cancel)
+}
+
+func (s *Subscription) cancel() {
+	close(s.done)
 	s.c.mutex.Lock()
 	defer s.c.mutex.Unlock()
 	for i := range s.c.topics[s.topic] {
@@ -132,4 +720,17 @@ func (s *Subscription) Cancel() {
 			break
 		}
 	}
+	for _, sub := range s.c.topics[s.topic] {
+		if sub.opts.group == s.opts.group {
+			return
+		}
+	}
+	if len(s.c.topics[s.topic]) == 0 {
+		delete(s.c.topics, s.topic)
+	}
+	if s.opts.group != "" {
+		s.c.send([]interface{}{"u", s.topic, s.opts.group})
+	} else {
+		s.c.send([]interface{}{"u", s.topic})
+	}
 }
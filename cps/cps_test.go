@@ -0,0 +1,801 @@
+package cps_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps"
+	"github.com/jakobvarmose/everything/cps/broker"
+	"github.com/jakobvarmose/everything/cps/store"
+)
+
+func connect(t *testing.T, b *broker.Broker) *cps.CPS {
+	c, err := b.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	sub := connect(t, b)
+	pub := connect(t, b)
+
+	s, err := sub.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Cancel()
+	// The subscription is in place once a synchronous publication from the
+	// same connection has been acknowledged.
+	err = sub.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.PublishSync(ctx, "t", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "hello" {
+		t.Errorf("received %q", msg.Data)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	server := connect(t, b)
+	client := connect(t, b)
+
+	s, err := server.Subscribe(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Cancel()
+	err = server.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		msg, err := s.Next(ctx)
+		if err != nil {
+			return
+		}
+		server.Respond(msg, append([]byte("re: "), msg.Data...))
+	}()
+	data, err := client.Request(ctx, "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "re: hello" {
+		t.Errorf("received %q", data)
+	}
+
+	// Nobody answers
+	short, cancel2 := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel2()
+	if _, err := client.Request(short, "nobody", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request without responder: %v", err)
+	}
+	if err := client.Respond(&cps.Message{Topic: "t"}, nil); err == nil {
+		t.Error("responded to a message without reply topic")
+	}
+}
+
+func TestPublishSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	b.Limits.MaxPayload = 4
+	c := connect(t, b)
+	if err := c.PublishSync(ctx, "t", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	// The server's error is returned
+	err := c.PublishSync(ctx, "t", []byte("too large"))
+	if err == nil || err.Error() != broker.ErrPayloadTooLarge.Error() {
+		t.Errorf("%v, expected %v", err, broker.ErrPayloadTooLarge)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	c := connect(t, b)
+	s, err := c.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c.Done()
+	if _, err := s.Next(ctx); err != cps.ErrClosed {
+		t.Errorf("%v, expected ErrClosed", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	// A client that can't reconnect
+	c, err := cps.NewConn(b.Pipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PublishSync(ctx, "t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if c.Err() != cps.ErrShutdown {
+		t.Errorf("%v, expected ErrShutdown", c.Err())
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	sub := connect(t, b)
+	pub := connect(t, b)
+
+	key1, _ := cps.GenerateKey()
+	key2, _ := cps.GenerateKey()
+	subKeys := cps.NewKeyring()
+	subKeys.Add(1, key1)
+	subKeys.Add(2, key2)
+	pubKeys := cps.NewKeyring()
+	pubKeys.Add(1, key1)
+
+	s, err := sub.Subscribe(ctx, "t", cps.Encrypted(subKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Cancel()
+	raw, err := sub.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Cancel()
+	err = sub.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pub.Publish("t", []byte("one"), cps.Encrypted(pubKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate to a key the subscriber has
+	pubKeys.Add(2, key2)
+	pubKeys.Use(2)
+	err = pub.Publish("t", []byte("two"), cps.Encrypted(pubKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and to one it doesn't have
+	key3, _ := cps.GenerateKey()
+	pubKeys.Add(3, key3)
+	pubKeys.Use(3)
+	err = pub.Publish("t", []byte("three"), cps.Encrypted(pubKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.Publish("t", []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		msg, err := raw.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := string(msg.Data); data == "one" || data == "two" || data == "three" {
+			t.Error("payload not encrypted")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := s.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[string(msg.Data)] = true
+	}
+	if !received["one"] || !received["two"] {
+		t.Errorf("received %v", received)
+	}
+	short, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+	if msg, err := s.Next(short); err == nil {
+		t.Errorf("received %q, which should have been dropped", msg.Data)
+	}
+}
+
+func TestSigned(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	sub := connect(t, b)
+	pub := connect(t, b)
+	publisher, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := sub.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Cancel()
+	verified, err := sub.Subscribe(ctx, "t", cps.VerifiedOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer verified.Cancel()
+	err = sub.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pub.PublishSync(ctx, "t", []byte("unsigned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.PublishSync(ctx, "t", []byte("signed"), cps.Signed(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := map[string]*cps.Message{}
+	for i := 0; i < 2; i++ {
+		msg, err := all.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[string(msg.Data)] = msg
+	}
+	if msg := received["unsigned"]; msg == nil || msg.Verified || msg.Publisher != nil {
+		t.Errorf("unsigned message %+v", msg)
+	}
+	if msg := received["signed"]; msg == nil || !msg.Verified || !publisher.Equal(msg.Publisher) {
+		t.Errorf("signed message %+v", msg)
+	}
+
+	msg, err := verified.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "signed" {
+		t.Errorf("received %q", msg.Data)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	pub := connect(t, b)
+	workers := []*cps.CPS{connect(t, b), connect(t, b)}
+
+	var subs []*cps.Subscription
+	for _, w := range workers {
+		s, err := w.Subscribe(ctx, "jobs", cps.Group("workers"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, s)
+		err = w.PublishSync(ctx, "other", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, job := range []string{"a", "b", "c", "d"} {
+		err := pub.PublishSync(ctx, "jobs", []byte(job))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each worker gets half of the jobs. The first one acknowledges its
+	// jobs, the second one disconnects without doing so.
+	received := map[string]bool{}
+	unacked := map[string]bool{}
+	for i, s := range subs {
+		for j := 0; j < 2; j++ {
+			msg, err := s.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received[string(msg.Data)] = true
+			if i == 0 {
+				msg.Ack()
+			} else {
+				unacked[string(msg.Data)] = true
+			}
+		}
+	}
+	if len(received) != 4 {
+		t.Errorf("received %v", received)
+	}
+	workers[1].Close()
+	for j := 0; j < 2; j++ {
+		msg, err := subs[0].Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !unacked[string(msg.Data)] {
+			t.Errorf("job %s redelivered", msg.Data)
+		}
+		delete(unacked, string(msg.Data))
+		msg.Ack()
+	}
+	short, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+	if msg, err := subs[0].Next(short); err == nil {
+		t.Errorf("received %q again", msg.Data)
+	}
+}
+
+// halfOpen returns a dialer that connects to b, and a function that makes
+// the most recent connection silently stop passing data in both
+// directions.
+func halfOpen(b *broker.Broker) (func() (net.Conn, error), func()) {
+	var mutex sync.Mutex
+	var stop chan struct{}
+	relay := func(dst, src net.Conn, stop chan struct{}) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				// Drop it
+			default:
+				dst.Write(buf[:n])
+			}
+		}
+	}
+	dial := func() (net.Conn, error) {
+		client, proxy := net.Pipe()
+		server := b.Pipe()
+		ch := make(chan struct{})
+		mutex.Lock()
+		stop = ch
+		mutex.Unlock()
+		go relay(proxy, server, ch)
+		go relay(server, proxy, ch)
+		return client, nil
+	}
+	freeze := func() {
+		mutex.Lock()
+		close(stop)
+		mutex.Unlock()
+	}
+	return dial, freeze
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	pub := connect(t, b)
+	dial, freeze := halfOpen(b)
+	c, err := cps.New(cps.Dialer(dial), cps.KeepAlive(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := c.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeze()
+	// The subscription works again once the client has noticed and
+	// reconnected
+	for {
+		err = pub.PublishSync(ctx, "t", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		short, cancel2 := context.WithTimeout(ctx, 50*time.Millisecond)
+		msg, err := s.Next(short)
+		cancel2()
+		if err == nil {
+			if string(msg.Data) != "hello" {
+				t.Errorf("received %q", msg.Data)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("not reconnected")
+		}
+	}
+	if c.Err() != nil {
+		t.Errorf("connection failed: %v", c.Err())
+	}
+}
+
+// proxyPipe connects to b through a proxy. It returns the client's end, and
+// the proxy's end towards the client, through which the test can send
+// anything or close the connection as the server would.
+func proxyPipe(b *broker.Broker) (net.Conn, net.Conn) {
+	client, proxy := net.Pipe()
+	server := b.Pipe()
+	go func() {
+		io.Copy(proxy, server)
+		proxy.Close()
+	}()
+	go func() {
+		io.Copy(server, proxy)
+		server.Close()
+	}()
+	return client, proxy
+}
+
+// resetConn fails reads like a connection reset by the peer.
+type resetConn struct {
+	net.Conn
+}
+
+func (c resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		err = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return n, err
+}
+
+// waitReceived publishes on the topic of s until s receives a message.
+func waitReceived(ctx context.Context, t *testing.T, pub *cps.CPS, s *cps.Subscription) {
+	t.Helper()
+	for {
+		err := pub.PublishSync(ctx, s.Topic(), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		_, err = s.Next(short)
+		cancel()
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatal("not reconnected")
+		}
+	}
+}
+
+func TestReconnectShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The first connection goes to a server that shuts down, the next ones
+	// to another
+	first := broker.New("")
+	second := broker.New("")
+	pub := connect(t, second)
+	var mutex sync.Mutex
+	proxies := 0
+	dial := func() (net.Conn, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		proxies++
+		if proxies == 1 {
+			return first.Pipe(), nil
+		}
+		return second.Pipe(), nil
+	}
+	c, err := cps.New(cps.Dialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := c.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitReceived(ctx, t, pub, s)
+	if c.Err() != nil {
+		t.Errorf("connection failed: %v", c.Err())
+	}
+}
+
+func TestReconnectBroken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	pub := connect(t, b)
+	proxies := make(chan net.Conn, 10)
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		client, proxy := proxyPipe(b)
+		proxies <- proxy
+		if dials == 2 {
+			return resetConn{client}, nil
+		}
+		return client, nil
+	}
+	c, err := cps.New(cps.Dialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := c.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReceived(ctx, t, pub, s)
+
+	// The server goes away in the middle of a frame
+	proxy := <-proxies
+	proxy.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	proxy.Close()
+	waitReceived(ctx, t, pub, s)
+
+	// The connection is reset
+	proxy = <-proxies
+	proxy.Close()
+	waitReceived(ctx, t, pub, s)
+	if c.Err() != nil {
+		t.Errorf("connection failed: %v", c.Err())
+	}
+}
+
+func TestKeepAliveLegacy(t *testing.T) {
+	// A server that only speaks JSON frames, and doesn't know pings
+	client, server := net.Pipe()
+	defer server.Close()
+	lines := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			if strings.HasPrefix(line, `["v"`) {
+				server.Write([]byte(`["v",1]` + "\n"))
+				continue
+			}
+			lines <- line
+		}
+	}()
+	c, err := cps.NewConn(client, cps.KeepAlive(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if c.Err() != nil {
+		t.Fatalf("connection failed: %v", c.Err())
+	}
+	err = c.Publish("t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lines; !strings.HasPrefix(line, `["p"`) {
+		t.Errorf("received %q", line)
+	}
+}
+
+func TestSubscribeContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	c := connect(t, b)
+
+	subCtx, cancelSub := context.WithCancel(ctx)
+	s, err := c.Subscribe(subCtx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PublishSync(ctx, "t", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-s.C():
+		if string(msg.Data) != "hello" {
+			t.Errorf("received %q", msg.Data)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	cancelSub()
+	select {
+	case msg, ok := <-s.C():
+		if ok {
+			t.Errorf("received %q after cancel", msg.Data)
+		}
+	case <-ctx.Done():
+		t.Fatal("channel not closed")
+	}
+	if _, err := s.Next(ctx); err != cps.ErrCanceled {
+		t.Errorf("%v, expected ErrCanceled", err)
+	}
+}
+
+func TestSubscribeLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	b.Limits.MaxSubscriptions = 1
+	c := connect(t, b)
+
+	if _, err := c.Subscribe(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Subscribe(ctx, "b", cps.Group("g"))
+	if err == nil || err.Error() != "subscription limit exceeded" {
+		t.Errorf("%v, expected the subscription limit", err)
+	}
+	_, err = c.Subscribe(ctx, "c")
+	if err == nil || err.Error() != "subscription limit exceeded" {
+		t.Errorf("%v, expected the subscription limit", err)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type point struct {
+		X, Y int
+		Name string `json:"name"`
+	}
+	for _, codec := range []cps.Codec{cps.JSON, cps.MessagePack} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		b := broker.New("")
+		c := connect(t, b)
+
+		s, err := c.Subscribe(ctx, "points")
+		if err != nil {
+			t.Fatal(err)
+		}
+		typed := cps.NewTyped[point](s, codec)
+		defer typed.Cancel()
+
+		data, err := codec.Marshal(point{1, -2, "p"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.PublishSync(ctx, "points", []byte{0xc1, '{'})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.PublishSync(ctx, "points", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p := <-typed.C():
+			if p != (point{1, -2, "p"}) {
+				t.Errorf("received %+v", p)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		select {
+		case err := <-typed.Errors():
+			var decodeErr *cps.DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.Message.Topic != "points" {
+				t.Errorf("error %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("no decode error")
+		}
+	}
+}
+
+func TestTypedGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	pub := connect(t, b)
+	worker := connect(t, b)
+	s, err := worker.Subscribe(ctx, "jobs", cps.Group("workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed := cps.NewTyped[string](s, cps.JSON)
+	typed.C()
+	// The subscription is in place once this is acknowledged
+	err = worker.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.PublishSync(ctx, "jobs", []byte(`"a"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value is decoded, but never received
+	time.Sleep(50 * time.Millisecond)
+	worker.Close()
+
+	other := connect(t, b)
+	s, err = other.Subscribe(ctx, "jobs", cps.Group("workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != `"a"` {
+		t.Errorf("received %s", msg.Data)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := broker.New("")
+	b.Persist("orders", store.Retention{})
+	c := connect(t, b)
+
+	for _, order := range []string{"a", "b", "c"} {
+		err := c.PublishSync(ctx, "orders", []byte(order))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := c.PublishSync(ctx, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.History(ctx, "orders", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Seq != 2 || string(msgs[0].Data) != "b" || string(msgs[1].Data) != "c" {
+		t.Errorf("history %v", msgs)
+	}
+	if msgs[0].Time.IsZero() || msgs[0].Topic != "orders" {
+		t.Errorf("message %+v", msgs[0])
+	}
+	_, err = c.History(ctx, "other", 1, 10)
+	if err == nil || err.Error() != broker.ErrNotPersisted.Error() {
+		t.Errorf("%v, expected an error for a topic that isn't persisted", err)
+	}
+}
@@ -1,86 +1,143 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jakobvarmose/everything/cps/broker"
+	"github.com/jakobvarmose/everything/cps/store"
 )
 
 func main() {
-	s, err := net.Listen("tcp", ":8707")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
+	listen := flag.String("listen", ":8707", "address to listen on")
+	peers := flag.String("peers", "", "comma separated addresses of the other cluster nodes")
+	id := flag.String("id", "", "node id, random if empty")
+	peerSecret := flag.String("peer-secret", os.Getenv("CPS_PEER_SECRET"), "secret shared by the cluster nodes, by default from $CPS_PEER_SECRET")
+	ws := flag.String("ws", "", "address to accept WebSocket connections on, disabled if empty")
+	admin := flag.String("admin", "", "address to serve metrics and introspection on, disabled if empty")
+	drain := flag.Duration("drain", 10*time.Second, "time allowed for flushing queued messages on shutdown")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "interval between pings to clients, 0 to disable")
+	var limits broker.Limits
+	flag.Float64Var(&limits.MessagesPerSecond, "max-msgs", 0, "messages per second a connection may publish, 0 for no limit")
+	flag.Float64Var(&limits.BytesPerSecond, "max-bytes", 0, "bytes per second a connection may publish, 0 for no limit")
+	flag.Float64Var(&limits.TopicMessagesPerSecond, "topic-max-msgs", 0, "messages per second that may be published on a topic, 0 for no limit")
+	flag.Float64Var(&limits.TopicBytesPerSecond, "topic-max-bytes", 0, "bytes per second that may be published on a topic, 0 for no limit")
+	flag.IntVar(&limits.MaxSubscriptions, "max-subs", 0, "subscriptions per connection, 0 for no limit")
+	flag.IntVar(&limits.MaxPayload, "max-payload", 0, "largest payload in bytes, 0 for no limit")
+	dir := flag.String("store", "", "directory to keep persisted topics in, in memory if empty")
+	persist := flag.String("persist", "", "comma separated topics to persist, each optionally followed by :maxage and :maxbytes, as in orders:24h:1000000")
+	flag.Parse()
+
+	if *peers != "" && *peerSecret == "" {
+		fmt.Fprintln(os.Stderr, "-peers requires -peer-secret")
 		return
 	}
-	for {
-		c, err := s.Accept()
+
+	persisted := map[string]store.Retention{}
+	for _, spec := range strings.Split(*persist, ",") {
+		if spec == "" {
+			continue
+		}
+		topic, r, err := parseRetention(spec)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
-			continue
+			return
 		}
-		go handle(c)
+		persisted[topic] = r
 	}
-}
 
-var subscriptions sync.Map
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-func handle(c net.Conn) {
-	defer c.Close()
-	r := bufio.NewReader(c)
-	for {
-		line, _, err := r.ReadLine()
-		if err == io.EOF {
-			return
-		}
+	s, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	b := broker.New(*id)
+	b.Limits = limits
+	b.KeepAlive = *keepAlive
+	b.PeerSecret = *peerSecret
+	if *dir != "" {
+		l, err := store.OpenLog(*dir, 0)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return
 		}
-		var obj []interface{}
-		err = json.Unmarshal(line, &obj)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			continue
-		}
-		if len(obj) < 1 {
-			continue
+		defer l.Close()
+		b.Store = l
+	}
+	for topic, r := range persisted {
+		b.Persist(topic, r)
+	}
+	for _, addr := range strings.Split(*peers, ",") {
+		if addr != "" {
+			go b.Connect(addr)
 		}
-		switch obj[0] {
-		case "s":
-			if len(obj) < 2 {
-				continue
-			}
-			str, _ := obj[1].(string)
-			m, _ := subscriptions.LoadOrStore(str, new(sync.Map))
-			m.(*sync.Map).Store(c, true)
-		case "u":
-			if len(obj) < 2 {
-				continue
-			}
-			str, _ := obj[1].(string)
-			m, _ := subscriptions.LoadOrStore(str, new(sync.Map))
-			m.(*sync.Map).Delete(c)
-		case "p":
-			if len(obj) < 3 {
-				continue
-			}
-			line2, err := json.Marshal(obj)
-			if err != nil {
+	}
+	var servers []*http.Server
+	if *ws != "" {
+		servers = append(servers, &http.Server{Addr: *ws, Handler: b.WebSocketHandler()})
+	}
+	if *admin != "" {
+		servers = append(servers, &http.Server{Addr: *admin, Handler: b.AdminHandler()})
+	}
+	for _, srv := range servers {
+		go func() {
+			err := srv.ListenAndServe()
+			if err != http.ErrServerClosed {
 				fmt.Fprintln(os.Stderr, err.Error())
-				continue
 			}
-			str, _ := obj[1].(string)
-			m, _ := subscriptions.LoadOrStore(str, new(sync.Map))
-			m.(*sync.Map).Range(func(key interface{}, value interface{}) bool {
-				key.(net.Conn).Write(append(line2, '\n'))
-				return true
-			})
-		case "x":
-			return
+		}()
+	}
+	go func() {
+		err := b.Serve(s)
+		if err != broker.ErrClosed {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		stop()
+	}()
+
+	<-ctx.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), *drain)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
+	err = b.Shutdown(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+// parseRetention parses topic[:maxage[:maxbytes]].
+func parseRetention(spec string) (string, store.Retention, error) {
+	var r store.Retention
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return "", r, fmt.Errorf("invalid topic to persist %q", spec)
+	}
+	var err error
+	if len(parts) >= 2 && parts[1] != "" {
+		r.MaxAge, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return "", r, err
+		}
+	}
+	if len(parts) >= 3 && parts[2] != "" {
+		r.MaxBytes, err = strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return "", r, err
 		}
 	}
+	return parts[0], r, nil
 }
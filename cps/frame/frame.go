@@ -0,0 +1,232 @@
+// Package frame implements the wire formats spoken between cps clients and
+// servers.
+//
+// A connection starts out with JSON frames, one array per line. A client
+// that supports binary frames sends ["v", 2] as its first frame. A server
+// that supports them answers ["v", 2] and from then on both sides send
+// MessagePack arrays prefixed with their length as a 32 bit big endian
+// integer. Servers that don't understand the handshake ignore it, so the
+// client keeps using JSON.
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+type Format int
+
+const (
+	JSON Format = iota
+	Binary
+)
+
+// Version is the protocol version announced in the handshake.
+const Version = 2
+
+// MaxSize is the largest frame accepted unless a Reader is given a limit.
+const MaxSize = 64 << 20
+
+var (
+	ErrMalformed = errors.New("malformed frame")
+	ErrTooLarge  = errors.New("frame too large")
+)
+
+type Reader struct {
+	r      *bufio.Reader
+	Format Format
+	// Limit is the largest frame accepted, in bytes. Zero means MaxSize.
+	Limit int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Read returns the next frame. Errors wrapping ErrMalformed only affect a
+// single frame and reading may continue.
+func (r *Reader) Read() ([]interface{}, error) {
+	limit := r.Limit
+	if limit <= 0 {
+		limit = MaxSize
+	}
+	if r.Format == Binary {
+		var size [4]byte
+		_, err := io.ReadFull(r.r, size[:])
+		if err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if uint64(n) > uint64(limit) {
+			return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, n)
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r.r, buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		return decode(buf)
+	}
+	line, err := r.readLine(limit)
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	var obj []interface{}
+	err = json.Unmarshal(bytes.TrimRight(line, "\r\n"), &obj)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return obj, nil
+}
+
+// readLine reads up to and including the next newline, but fails as soon as
+// the line grows beyond limit bytes.
+func (r *Reader) readLine(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		buf, err := r.r.ReadSlice('\n')
+		if len(line)+len(buf) > limit {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, limit)
+		}
+		line = append(line, buf...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Encode returns obj in format f. Byte slices are sent as base64 strings in
+// JSON frames.
+func Encode(f Format, obj []interface{}) ([]byte, error) {
+	if f == Binary {
+		buf := make([]byte, 4, 64)
+		buf, err := appendValue(buf, obj)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+		return buf, nil
+	}
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// Encoded holds a frame and its encodings, so that a frame sent to many
+// connections is only encoded once per format.
+type Encoded struct {
+	obj []interface{}
+	buf [2][]byte
+	err [2]error
+}
+
+func NewEncoded(obj []interface{}) *Encoded {
+	return &Encoded{obj: obj}
+}
+
+func (e *Encoded) Bytes(f Format) ([]byte, error) {
+	if e.buf[f] == nil && e.err[f] == nil {
+		e.buf[f], e.err[f] = Encode(f, e.obj)
+	}
+	return e.buf[f], e.err[f]
+}
+
+// Bytes converts a payload element to bytes. JSON frames carry payloads as
+// base64 strings and binary frames as raw bytes.
+func Bytes(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return v, true
+	case string:
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// Uint converts a numeric element to an integer.
+func Uint(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	case float64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+// Negotiate performs the client side of the handshake and returns the
+// format to use on conn. It falls back to JSON if the server doesn't answer
+// within timeout.
+func Negotiate(conn net.Conn, r *Reader, timeout time.Duration) (Format, error) {
+	buf, err := Encode(JSON, []interface{}{"v", Version})
+	if err != nil {
+		return JSON, err
+	}
+	_, err = conn.Write(buf)
+	if err != nil {
+		return JSON, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	obj, err := r.Read()
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return JSON, nil
+	}
+	if err != nil {
+		return JSON, err
+	}
+	if len(obj) < 2 || obj[0] != "v" {
+		return JSON, fmt.Errorf("%w: unexpected handshake reply", ErrMalformed)
+	}
+	if v, _ := Uint(obj[1]); v < Version {
+		return JSON, nil
+	}
+	r.Format = Binary
+	return Binary, nil
+}
+
+// Accept performs the server side of the handshake after the client sent
+// ["v", version]. It returns the format to use from now on.
+func Accept(conn net.Conn, r *Reader, obj []interface{}) (Format, error) {
+	if len(obj) < 2 {
+		return r.Format, nil
+	}
+	if v, _ := Uint(obj[1]); v < Version {
+		return r.Format, nil
+	}
+	buf, err := Encode(JSON, []interface{}{"v", Version})
+	if err != nil {
+		return r.Format, err
+	}
+	_, err = conn.Write(buf)
+	if err != nil {
+		return r.Format, err
+	}
+	r.Format = Binary
+	return Binary, nil
+}
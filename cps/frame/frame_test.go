@@ -0,0 +1,198 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	objs := [][]interface{}{
+		{},
+		{"s", "topic"},
+		{"p", "topic", []byte("hello"), "_INBOX.1", uint64(7)},
+		{"p", "", []byte{}, nil, true, false},
+		{uint64(0x7f), uint64(0xff), uint64(0x1234), uint64(0x12345678), uint64(1 << 40)},
+		{int64(-1), int64(-33), int64(-1000), int64(-100000), int64(-1 << 40), 1.5},
+		{strings.Repeat("x", 31), strings.Repeat("x", 200), strings.Repeat("x", 70000)},
+		{bytes.Repeat([]byte{1}, 300), bytes.Repeat([]byte{2}, 70000)},
+		{[]interface{}{"nested", uint64(1)}, make([]interface{}, 20)},
+		{map[string]interface{}{}, map[string]interface{}{"a": uint64(1), "b": []interface{}{"x"}}},
+	}
+	for _, obj := range objs {
+		buf, err := Encode(Binary, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(bytes.NewReader(buf))
+		r.Format = Binary
+		result, err := r.Read()
+		if err != nil {
+			t.Fatalf("%v: %s", obj, err)
+		}
+		if !reflect.DeepEqual(result, obj) {
+			t.Errorf("%v decoded as %v", obj, result)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	big := map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		big[strings.Repeat("k", i+1)] = int64(-i - 1)
+	}
+	for _, v := range []interface{}{"hello", uint64(1), nil, big} {
+		buf, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Unmarshal(buf)
+		if err != nil {
+			t.Fatalf("%v: %s", v, err)
+		}
+		if !reflect.DeepEqual(result, v) {
+			t.Errorf("%v decoded as %v", v, result)
+		}
+	}
+	// A map with an integer key
+	result, err := Unmarshal([]byte{0x81, 0x01, 0xa1, 'x'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, map[string]interface{}{"1": "x"}) {
+		t.Errorf("decoded as %v", result)
+	}
+}
+
+func TestJSONPayload(t *testing.T) {
+	buf, err := Encode(JSON, []interface{}{"p", "topic", []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "[\"p\",\"topic\",\"aGVsbG8=\"]\n" {
+		t.Errorf("encoded as %q", buf)
+	}
+	obj, err := NewReader(bytes.NewReader(buf)).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := Bytes(obj[2])
+	if !ok || string(data) != "hello" {
+		t.Errorf("payload decoded as %q", data)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for _, buf := range [][]byte{
+		{0, 0, 0, 1, 0xc1},
+		{0, 0, 0, 1, 0x01},
+		{0, 0, 0, 2, 0x91, 0xc4},
+		{0, 0, 0, 3, 0x91, 0xc4, 0x05},
+		{0, 0, 0, 2, 0xdd, 0xff},
+		{0, 0, 0, 2, 0x90, 0x90},
+	} {
+		r := NewReader(bytes.NewReader(buf))
+		r.Format = Binary
+		_, err := r.Read()
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%v: %v, expected ErrMalformed", buf, err)
+		}
+	}
+	_, err := NewReader(strings.NewReader("{}\n")).Read()
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("%v, expected ErrMalformed", err)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	// The size is checked before anything is allocated
+	r := NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	r.Format = Binary
+	if _, err := r.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("%v, expected ErrTooLarge", err)
+	}
+
+	line := `["p","t","` + strings.Repeat("A", 8000) + `"]` + "\n"
+	r = NewReader(strings.NewReader(line))
+	r.Limit = len(line)
+	if _, err := r.Read(); err != nil {
+		t.Errorf("frame at the limit: %v", err)
+	}
+	r = NewReader(strings.NewReader(line))
+	r.Limit = len(line) - 1
+	if _, err := r.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("%v, expected ErrTooLarge", err)
+	}
+	buf, err := Encode(Binary, []interface{}{"p", "t", make([]byte, 100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(bytes.NewReader(buf))
+	r.Format = Binary
+	r.Limit = 100
+	if _, err := r.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("%v, expected ErrTooLarge", err)
+	}
+}
+
+func TestNestingLimit(t *testing.T) {
+	nested := func(depth int) []byte {
+		buf := bytes.Repeat([]byte{0x91}, depth)
+		return append(buf, 0xc0)
+	}
+	if _, err := Unmarshal(nested(maxDepth)); err != nil {
+		t.Errorf("%d levels: %v", maxDepth, err)
+	}
+	if _, err := Unmarshal(nested(maxDepth + 1)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("%d levels: %v, expected ErrMalformed", maxDepth+1, err)
+	}
+
+	// A frame as deep as it is long doesn't crash the reader
+	frame := nested(1 << 20)
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	r := NewReader(bytes.NewReader(append(buf, frame...)))
+	r.Format = Binary
+	if _, err := r.Read(); !errors.Is(err, ErrMalformed) {
+		t.Errorf("%v, expected ErrMalformed", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		r := NewReader(b)
+		obj, err := r.Read()
+		if err != nil {
+			return
+		}
+		Accept(b, r, obj)
+	}()
+	format, err := Negotiate(a, NewReader(a), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != Binary {
+		t.Error("expected binary format")
+	}
+}
+
+func TestNegotiateLegacy(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go NewReader(b).Read()
+	format, err := Negotiate(a, NewReader(a), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != JSON {
+		t.Error("expected JSON format")
+	}
+}
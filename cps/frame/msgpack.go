@@ -0,0 +1,361 @@
+package frame
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The subset of MessagePack used by frames: nil, booleans, integers,
+// floats, strings, binary data and arrays. Payloads may also use maps.
+
+// Marshal returns the MessagePack encoding of v, which may be made of nil,
+// booleans, numbers, strings, byte slices, []interface{} and
+// map[string]interface{}.
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+// Unmarshal parses a single MessagePack value. Maps are returned as
+// map[string]interface{}, with other keys formatted as strings.
+func Unmarshal(buf []byte) (interface{}, error) {
+	d := decoder{buf: buf}
+	v := d.value()
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("trailing data")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return v, nil
+}
+
+func appendValue(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendInt(buf, int64(v)), nil
+	case int64:
+		return appendInt(buf, v), nil
+	case uint64:
+		return appendUint(buf, v), nil
+	case float64:
+		if v >= 0 && v < math.MaxUint64 && v == math.Trunc(v) {
+			return appendUint(buf, uint64(v)), nil
+		}
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v)), nil
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf = append(buf, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			buf = append(buf, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xda)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdb)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+		return append(buf, v...), nil
+	case []byte:
+		n := len(v)
+		switch {
+		case n <= math.MaxUint8:
+			buf = append(buf, 0xc4, byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xc5)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xc6)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+		return append(buf, v...), nil
+	case []interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			buf = append(buf, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xdc)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdd)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+		var err error
+		for _, item := range v {
+			buf, err = appendValue(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			buf = append(buf, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xde)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdf)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+		keys := make([]string, 0, n)
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// Sorted, so equal maps encode the same way
+		sort.Strings(keys)
+		var err error
+		for _, key := range keys {
+			buf, _ = appendValue(buf, key)
+			buf, err = appendValue(buf, v[key])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+func appendUint(buf []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(buf, byte(v))
+	case v <= math.MaxUint8:
+		return append(buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), v)
+}
+
+func appendInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendUint(buf, uint64(v))
+	case v >= -32:
+		return append(buf, byte(v))
+	case v >= math.MinInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(v))
+}
+
+// decode parses a frame, which must be a single array.
+func decode(buf []byte) ([]interface{}, error) {
+	d := decoder{buf: buf}
+	v := d.value()
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("trailing data")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	obj, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: not an array", ErrMalformed)
+	}
+	return obj, nil
+}
+
+// maxDepth is how deep arrays and maps may be nested. The decoder recurses
+// for every level, so without a limit a frame of nested arrays could
+// overflow the stack.
+const maxDepth = 32
+
+type decoder struct {
+	buf   []byte
+	err   error
+	depth int
+}
+
+// enter starts a nested array or map, and reports whether it may be
+// decoded. Every successful call must be matched by a deferred leave.
+func (d *decoder) enter() bool {
+	if d.depth >= maxDepth {
+		d.fail("nested too deeply")
+		return false
+	}
+	d.depth++
+	return true
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformed, msg)
+	}
+	d.buf = nil
+}
+
+func (d *decoder) take(n int) []byte {
+	if n < 0 || len(d.buf) < n {
+		d.fail("unexpected end of data")
+		// Fixed size reads don't need to check for errors
+		return make([]byte, 8)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) size(n int) int {
+	b := d.take(n)
+	if d.err != nil {
+		return 0
+	}
+	switch n {
+	case 1:
+		return int(b[0])
+	case 2:
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func (d *decoder) value() interface{} {
+	b := d.take(1)
+	if d.err != nil {
+		return nil
+	}
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return uint64(t)
+	case t >= 0xe0:
+		return int64(int8(t))
+	case t >= 0xa0 && t <= 0xbf:
+		return string(d.take(int(t & 0x1f)))
+	case t >= 0x90 && t <= 0x9f:
+		return d.array(int(t & 0x0f))
+	case t >= 0x80 && t <= 0x8f:
+		return d.mapping(int(t & 0x0f))
+	}
+	switch t {
+	case 0xc0:
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4:
+		return d.bytes(d.size(1))
+	case 0xc5:
+		return d.bytes(d.size(2))
+	case 0xc6:
+		return d.bytes(d.size(4))
+	case 0xca:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.take(4))))
+	case 0xcb:
+		return math.Float64frombits(binary.BigEndian.Uint64(d.take(8)))
+	case 0xcc:
+		return uint64(d.take(1)[0])
+	case 0xcd:
+		return uint64(binary.BigEndian.Uint16(d.take(2)))
+	case 0xce:
+		return uint64(binary.BigEndian.Uint32(d.take(4)))
+	case 0xcf:
+		return binary.BigEndian.Uint64(d.take(8))
+	case 0xd0:
+		return int64(int8(d.take(1)[0]))
+	case 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(d.take(2))))
+	case 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(d.take(4))))
+	case 0xd3:
+		return int64(binary.BigEndian.Uint64(d.take(8)))
+	case 0xd9:
+		return string(d.take(d.size(1)))
+	case 0xda:
+		return string(d.take(d.size(2)))
+	case 0xdb:
+		return string(d.take(d.size(4)))
+	case 0xdc:
+		return d.array(d.size(2))
+	case 0xdd:
+		return d.array(d.size(4))
+	case 0xde:
+		return d.mapping(d.size(2))
+	case 0xdf:
+		return d.mapping(d.size(4))
+	}
+	d.fail(fmt.Sprintf("unsupported type 0x%02x", t))
+	return nil
+}
+
+func (d *decoder) bytes(n int) []byte {
+	b := d.take(n)
+	if d.err != nil {
+		return nil
+	}
+	return append(make([]byte, 0, n), b...)
+}
+
+func (d *decoder) array(n int) []interface{} {
+	if n > len(d.buf) {
+		// Every element takes at least one byte
+		d.fail("unexpected end of data")
+		return nil
+	}
+	if !d.enter() {
+		return nil
+	}
+	defer d.leave()
+	arr := make([]interface{}, n)
+	for i := range arr {
+		arr[i] = d.value()
+		if d.err != nil {
+			return nil
+		}
+	}
+	return arr
+}
+
+func (d *decoder) mapping(n int) map[string]interface{} {
+	if n > len(d.buf)/2 {
+		// Every entry takes at least two bytes
+		d.fail("unexpected end of data")
+		return nil
+	}
+	if !d.enter() {
+		return nil
+	}
+	defer d.leave()
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key := d.value()
+		value := d.value()
+		if d.err != nil {
+			return nil
+		}
+		if str, ok := key.(string); ok {
+			m[str] = value
+		} else {
+			m[fmt.Sprint(key)] = value
+		}
+	}
+	return m
+}
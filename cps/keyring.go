@@ -0,0 +1,108 @@
+package cps
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// Keyring holds the symmetric keys of an encrypted topic. Publications are
+// sealed with the current key, and subscribers open them with whichever key
+// they were sealed with. To rotate keys, add the new key on all subscribers
+// before using it on the publishers.
+//
+// A sealed payload consists of the 32 bit key id, a 24 byte nonce and the
+// secretbox.
+type Keyring struct {
+	mutex   sync.Mutex
+	keys    map[uint32]*[32]byte
+	current uint32
+	ok      bool
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[uint32]*[32]byte),
+	}
+}
+
+// GenerateKey returns a random key.
+func GenerateKey() (*[32]byte, error) {
+	key := new([32]byte)
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Add adds a key. The first key added becomes the current key.
+func (k *Keyring) Add(id uint32, key *[32]byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[id] = key
+	if !k.ok {
+		k.current = id
+		k.ok = true
+	}
+}
+
+// Use makes the key with the given id the current key.
+func (k *Keyring) Use(id uint32) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.keys[id] == nil {
+		return ErrUnknownKey
+	}
+	k.current = id
+	k.ok = true
+	return nil
+}
+
+// Remove removes a key, for instance after it has been rotated out.
+func (k *Keyring) Remove(id uint32) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.keys, id)
+	if k.current == id {
+		k.ok = false
+	}
+}
+
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	k.mutex.Lock()
+	id, key, ok := k.current, k.keys[k.current], k.ok
+	k.mutex.Unlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4, 4+len(nonce)+secretbox.Overhead+len(data))
+	binary.BigEndian.PutUint32(buf, id)
+	buf = append(buf, nonce[:]...)
+	return secretbox.Seal(buf, data, &nonce, key), nil
+}
+
+func (k *Keyring) open(buf []byte) ([]byte, bool) {
+	if len(buf) < 4+24+secretbox.Overhead {
+		return nil, false
+	}
+	k.mutex.Lock()
+	key := k.keys[binary.BigEndian.Uint32(buf)]
+	k.mutex.Unlock()
+	if key == nil {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], buf[4:])
+	return secretbox.Open(nil, buf[4+24:], &nonce, key)
+}
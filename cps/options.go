@@ -0,0 +1,164 @@
+package cps
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Option changes how a message is published or how a subscription treats
+// the messages it receives.
+type Option func(*options)
+
+type options struct {
+	keys     *Keyring
+	key      ed25519.PrivateKey
+	verified bool
+	group    string
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Encrypted seals published payloads with the current key of k, and opens
+// received payloads with any key of k. Messages that can't be opened are
+// dropped.
+func Encrypted(k *Keyring) Option {
+	return func(o *options) {
+		o.keys = k
+	}
+}
+
+// Signed signs publications with key, so subscribers can tell who
+// published them.
+func Signed(key ed25519.PrivateKey) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// VerifiedOnly drops received messages that aren't signed or whose
+// signature is invalid.
+func VerifiedOnly() Option {
+	return func(o *options) {
+		o.verified = true
+	}
+}
+
+// Group makes the subscription a member of the named group. Each message
+// published on the topic goes to only one member of the group, which must
+// acknowledge it with Message.Ack.
+func Group(name string) Option {
+	return func(o *options) {
+		o.group = name
+	}
+}
+
+// publication returns the frame that publishes data on topic. The frame is
+// ["p", topic, data, reply, id, publisher, signature], where the elements
+// after data may be left out if they are empty.
+func (o *options) publication(topic string, data []byte, reply string, id interface{}) ([]interface{}, error) {
+	if o.keys != nil {
+		var err error
+		data, err = o.keys.seal(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	obj := []interface{}{"p", topic, data}
+	if reply != "" || id != nil || o.key != nil {
+		obj = append(obj, reply, id)
+	}
+	if o.key != nil {
+		obj = append(obj,
+			[]byte(o.key.Public().(ed25519.PublicKey)),
+			ed25519.Sign(o.key, signedData(topic, reply, data)),
+		)
+	}
+	return obj, nil
+}
+
+// signedData returns what the signature of a publication covers. The topic
+// is included so a message can't be replayed on another topic, and the
+// reply topic so that responses can't be redirected.
+func signedData(topic string, reply string, data []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(topic)))
+	buf = append(buf, topic...)
+	buf = binary.AppendUvarint(buf, uint64(len(reply)))
+	buf = append(buf, reply...)
+	return append(buf, data...)
+}
+
+// decode returns the message as seen by a subscription, or false if it
+// should be dropped.
+func (o *options) decode(msg *Message) (*Message, bool) {
+	if o.verified && !msg.Verified {
+		return nil, false
+	}
+	if o.keys != nil {
+		data, ok := o.keys.open(msg.Data)
+		if !ok {
+			return nil, false
+		}
+		msg2 := *msg
+		msg2.Data = data
+		msg = &msg2
+	}
+	return msg, true
+}
+
+// DialOption changes how New and NewConn connect to the server.
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	address   string
+	dial      func() (net.Conn, error)
+	keepAlive time.Duration
+}
+
+// defaultKeepAlive is how often clients ping the server unless told
+// otherwise.
+const defaultKeepAlive = 30 * time.Second
+
+func newDialOptions(opts []DialOption) dialOptions {
+	o := dialOptions{
+		address:   serverAddress,
+		keepAlive: defaultKeepAlive,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Address makes New connect to the server at addr instead of the default
+// one.
+func Address(addr string) DialOption {
+	return func(o *dialOptions) {
+		o.address = addr
+	}
+}
+
+// Dialer makes the client open its connections with dial. It overrides
+// Address.
+func Dialer(dial func() (net.Conn, error)) DialOption {
+	return func(o *dialOptions) {
+		o.dial = dial
+	}
+}
+
+// KeepAlive sets how often the client pings the server. The connection is
+// considered dead, and replaced, if nothing is received from the server for
+// two intervals. Zero disables pings. Servers that only speak JSON frames
+// don't answer pings and are never pinged.
+func KeepAlive(interval time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.keepAlive = interval
+	}
+}
@@ -0,0 +1,27 @@
+package cps
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestSignedReply(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newOptions([]Option{Signed(key)})
+	obj, err := o.publication("t", []byte("data"), "reply", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server passes on topic, data, reply, publisher and signature
+	fields := []interface{}{obj[1], obj[2], obj[3], obj[5], obj[6]}
+	if msg := (&CPS{}).message(fields); msg == nil || !msg.Verified {
+		t.Fatalf("message %+v", msg)
+	}
+	fields[2] = "other"
+	if msg := (&CPS{}).message(fields); msg == nil || msg.Verified {
+		t.Errorf("message with another reply topic %+v", msg)
+	}
+}
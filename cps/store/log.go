@@ -0,0 +1,432 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Log keeps every topic in a directory of its own, named by the hex
+// encoding of the topic. The records are appended to segment files, each
+// named by the sequence number of its first record. A record is
+//
+//	length  uint32, the size of the rest of the record
+//	seq     uint64
+//	time    int64, in nanoseconds since 1970
+//	data    []byte
+//	crc     uint32, IEEE checksum of seq, time and data
+//
+// with all integers in big endian. Truncate removes whole segments only,
+// so some records before the requested sequence number may remain. It
+// starts a new segment when records of the current one must go, so that
+// the current one can be removed once all of its records must, however
+// little the topic is used.
+// Records are written without syncing, so they survive the process
+// exiting, but not necessarily the machine crashing.
+type Log struct {
+	dir         string
+	segmentSize int64
+
+	mutex  sync.Mutex
+	topics map[string]*logTopic
+	closed bool
+}
+
+type logTopic struct {
+	dir      string
+	segments []*segment
+	file     *os.File
+}
+
+type segment struct {
+	path  string
+	first uint64
+	count uint64
+	size  int64
+	bytes int64
+}
+
+const (
+	recordHeader  = 4 + 8 + 8
+	recordTrailer = 4
+)
+
+// DefaultSegmentSize is the size segments grow to before a new one is
+// started, unless OpenLog is told otherwise.
+const DefaultSegmentSize = 16 << 20
+
+// OpenLog opens the log in dir, creating it if necessary. A record that
+// was only partly written when the process stopped is discarded, along
+// with any that follow it in the same segment. Segments are started once
+// the current one reaches segmentSize bytes, or DefaultSegmentSize if
+// segmentSize is zero.
+func OpenLog(dir string, segmentSize int64) (*Log, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+		topics:      make(map[string]*logTopic),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		t, err := openTopic(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.topics[string(name)] = t
+	}
+	return l, nil
+}
+
+func openTopic(dir string) (*logTopic, error) {
+	t := &logTopic{dir: dir}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		first, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		t.segments = append(t.segments, &segment{
+			path:  filepath.Join(dir, entry.Name()),
+			first: first,
+		})
+	}
+	sort.Slice(t.segments, func(i, j int) bool {
+		return t.segments[i].first < t.segments[j].first
+	})
+	for _, s := range t.segments {
+		err = s.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(t.segments) > 0 {
+		err = t.openLast()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// load counts the records of the segment and cuts off anything after the
+// last intact one.
+func (s *segment) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.count, s.size, s.bytes = 0, 0, 0
+	err = scan(f, func(rec Record, end int64) bool {
+		if rec.Seq != s.first+s.count {
+			return false
+		}
+		s.count++
+		s.size = end
+		s.bytes += int64(len(rec.Data))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != s.size {
+		return os.Truncate(s.path, s.size)
+	}
+	return nil
+}
+
+// scan calls fn with every intact record of r and the offset just after
+// it, until fn returns false. It stops quietly at the first damaged
+// record.
+func scan(r io.Reader, fn func(rec Record, end int64) bool) error {
+	var offset int64
+	var header [recordHeader]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if n < recordHeader-4+recordTrailer {
+			return nil
+		}
+		rest := make([]byte, n-(recordHeader-4))
+		_, err = io.ReadFull(r, rest)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := rest[:len(rest)-recordTrailer]
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(data)
+		if crc.Sum32() != binary.BigEndian.Uint32(rest[len(rest)-recordTrailer:]) {
+			return nil
+		}
+		offset += 4 + n
+		rec := Record{
+			Seq:  binary.BigEndian.Uint64(header[4:12]),
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[12:20]))),
+			Data: data,
+		}
+		if !fn(rec, offset) {
+			return nil
+		}
+	}
+}
+
+func appendRecord(buf []byte, seq uint64, t time.Time, data []byte) []byte {
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(recordHeader-4+len(data)+recordTrailer))
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.UnixNano()))
+	buf = append(buf, data...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start+4:]))
+}
+
+// openLast opens the last segment for appending, if there is one.
+func (t *logTopic) openLast() error {
+	if len(t.segments) == 0 {
+		return nil
+	}
+	s := t.segments[len(t.segments)-1]
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	t.file = f
+	return nil
+}
+
+func (t *logTopic) next() uint64 {
+	if len(t.segments) == 0 {
+		return 1
+	}
+	last := t.segments[len(t.segments)-1]
+	return last.first + last.count
+}
+
+// startSegment closes the current segment and starts a new one.
+func (t *logTopic) startSegment() error {
+	if t.file != nil {
+		err := t.file.Close()
+		t.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	next := t.next()
+	t.segments = append(t.segments, &segment{
+		path:  filepath.Join(t.dir, fmt.Sprintf("%020d.log", next)),
+		first: next,
+	})
+	return t.openLast()
+}
+
+func (l *Log) Append(topic string, data []byte, now time.Time) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	t := l.topics[topic]
+	if t == nil {
+		t = &logTopic{dir: filepath.Join(l.dir, hex.EncodeToString([]byte(topic)))}
+		err := os.MkdirAll(t.dir, 0700)
+		if err != nil {
+			return 0, err
+		}
+		l.topics[topic] = t
+	}
+	if len(t.segments) == 0 || t.segments[len(t.segments)-1].size >= l.segmentSize {
+		err := t.startSegment()
+		if err != nil {
+			return 0, err
+		}
+	}
+	s := t.segments[len(t.segments)-1]
+	seq := s.first + s.count
+	buf := appendRecord(nil, seq, now, data)
+	_, err := t.file.Write(buf)
+	if err != nil {
+		// Don't leave a partial record behind the next one
+		t.file.Truncate(s.size)
+		return 0, err
+	}
+	s.count++
+	s.size += int64(len(buf))
+	s.bytes += int64(len(data))
+	return seq, nil
+}
+
+func (l *Log) Read(topic string, seq uint64, max int) ([]Record, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	t := l.topics[topic]
+	if t == nil {
+		return nil, nil
+	}
+	var records []Record
+	for _, s := range t.segments {
+		if len(records) >= max {
+			break
+		}
+		if s.count == 0 || s.first+s.count <= seq {
+			continue
+		}
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil, err
+		}
+		// Only the intact part of the segment is read
+		err = scan(io.LimitReader(f, s.size), func(rec Record, end int64) bool {
+			if rec.Seq >= seq {
+				records = append(records, rec)
+			}
+			return len(records) < max
+		})
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (l *Log) Truncate(topic string, seq uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	t := l.topics[topic]
+	// A crash may leave a topic without segments
+	if t == nil || len(t.segments) == 0 {
+		return nil
+	}
+	last := t.segments[len(t.segments)-1]
+	if last.count > 0 && last.first < seq {
+		err := t.startSegment()
+		if err != nil {
+			return err
+		}
+	}
+	// The last segment is kept, even if empty, as it holds the next
+	// sequence number
+	for len(t.segments) > 1 && t.segments[1].first <= seq {
+		err := os.Remove(t.segments[0].path)
+		if err != nil {
+			return err
+		}
+		t.segments = t.segments[1:]
+	}
+	return nil
+}
+
+func (l *Log) Info(topic string) (Info, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return Info{}, ErrClosed
+	}
+	t := l.topics[topic]
+	if t == nil || len(t.segments) == 0 {
+		return Info{First: 1, Next: 1}, nil
+	}
+	info := Info{
+		First: t.segments[0].first,
+		Next:  t.next(),
+	}
+	for _, s := range t.segments {
+		info.Bytes += s.bytes
+	}
+	return info, nil
+}
+
+func (l *Log) Topics() ([]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	var topics []string
+	for name, t := range l.topics {
+		for _, s := range t.segments {
+			if s.count > 0 {
+				topics = append(topics, name)
+				break
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Close syncs the segments being appended to and closes them.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.closed = true
+	var first error
+	for _, t := range l.topics {
+		if t.file == nil {
+			continue
+		}
+		err := t.file.Sync()
+		if err == nil {
+			err = t.file.Close()
+		} else {
+			t.file.Close()
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
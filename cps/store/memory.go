@@ -0,0 +1,142 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps the records in memory, so they are lost
+// when the process exits.
+type Memory struct {
+	mutex  sync.Mutex
+	topics map[string]*memoryTopic
+	closed bool
+}
+
+type memoryTopic struct {
+	first   uint64
+	records []Record
+	bytes   int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		topics: make(map[string]*memoryTopic),
+	}
+}
+
+func (m *Memory) topic(name string) *memoryTopic {
+	t := m.topics[name]
+	if t == nil {
+		t = &memoryTopic{first: 1}
+		m.topics[name] = t
+	}
+	return t
+}
+
+func (m *Memory) Append(topic string, data []byte, now time.Time) (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	t := m.topic(topic)
+	seq := t.first + uint64(len(t.records))
+	t.records = append(t.records, Record{
+		Seq:  seq,
+		Time: now,
+		Data: append([]byte(nil), data...),
+	})
+	t.bytes += int64(len(data))
+	return seq, nil
+}
+
+func (m *Memory) Read(topic string, seq uint64, max int) ([]Record, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	t := m.topics[topic]
+	if t == nil {
+		return nil, nil
+	}
+	if seq < t.first {
+		seq = t.first
+	}
+	i := seq - t.first
+	if i >= uint64(len(t.records)) {
+		return nil, nil
+	}
+	records := t.records[i:]
+	if len(records) > max {
+		records = records[:max]
+	}
+	return append([]Record(nil), records...), nil
+}
+
+func (m *Memory) Truncate(topic string, seq uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	t := m.topics[topic]
+	if t == nil || seq <= t.first {
+		return nil
+	}
+	n := seq - t.first
+	if n > uint64(len(t.records)) {
+		n = uint64(len(t.records))
+	}
+	for _, rec := range t.records[:n] {
+		t.bytes -= int64(len(rec.Data))
+	}
+	t.records = append([]Record(nil), t.records[n:]...)
+	t.first += n
+	return nil
+}
+
+func (m *Memory) Info(topic string) (Info, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return Info{}, ErrClosed
+	}
+	t := m.topics[topic]
+	if t == nil {
+		return Info{First: 1, Next: 1}, nil
+	}
+	return Info{
+		First: t.first,
+		Next:  t.first + uint64(len(t.records)),
+		Bytes: t.bytes,
+	}, nil
+}
+
+func (m *Memory) Topics() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	var topics []string
+	for name, t := range m.topics {
+		if len(t.records) > 0 {
+			topics = append(topics, name)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (m *Memory) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.closed = true
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package store keeps the publications on persisted topics.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("store closed")
+
+// Record is a stored publication. Sequence numbers start at 1 for every
+// topic and increase by one per record.
+type Record struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte
+}
+
+// Info describes the records stored for a topic. First is the sequence
+// number of the oldest record and Next the one the next record will get,
+// so the topic is empty if they are equal. Bytes is the total size of the
+// data of the records.
+type Info struct {
+	First uint64
+	Next  uint64
+	Bytes int64
+}
+
+// Store holds the records of any number of topics. It must be safe for
+// concurrent use.
+type Store interface {
+	// Append adds a record to topic and returns its sequence number.
+	Append(topic string, data []byte, t time.Time) (uint64, error)
+	// Read returns up to max records of topic, starting with sequence
+	// number seq, or with the oldest record if that has been truncated.
+	Read(topic string, seq uint64, max int) ([]Record, error)
+	// Truncate discards the records of topic before sequence number seq.
+	// Implementations may keep some of them, but never more recent ones.
+	Truncate(topic string, seq uint64) error
+	// Info describes the records of topic.
+	Info(topic string) (Info, error)
+	// Topics lists the topics that have records.
+	Topics() ([]string, error)
+	Close() error
+}
+
+// Retention limits how long the records of a topic are kept. A zero field
+// means no limit.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+}
+
+// batchSize is the number of records Enforce reads at a time.
+const batchSize = 100
+
+// Enforce truncates the records of topic that r says must go.
+func (r Retention) Enforce(s Store, topic string, now time.Time) error {
+	if r.MaxAge <= 0 && r.MaxBytes <= 0 {
+		return nil
+	}
+	info, err := s.Info(topic)
+	if err != nil {
+		return err
+	}
+	excess := int64(0)
+	if r.MaxBytes > 0 {
+		excess = info.Bytes - r.MaxBytes
+	}
+	cut := info.First
+	for cut < info.Next {
+		records, err := s.Read(topic, cut, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, rec := range records {
+			expired := r.MaxAge > 0 && now.Sub(rec.Time) > r.MaxAge
+			if !expired && excess <= 0 {
+				return s.Truncate(topic, cut)
+			}
+			excess -= int64(len(rec.Data))
+			cut = rec.Seq + 1
+		}
+	}
+	return s.Truncate(topic, cut)
+}
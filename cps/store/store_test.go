@@ -0,0 +1,248 @@
+package store
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore checks the behaviour every Store must have.
+func testStore(t *testing.T, s Store) {
+	now := time.Unix(1700000000, 0)
+	for i := 1; i <= 10; i++ {
+		seq, err := s.Append("t", []byte(fmt.Sprint(i)), now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("appended as %d, expected %d", seq, i)
+		}
+	}
+	records, err := s.Read("t", 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Seq != 4 || string(records[2].Data) != "6" {
+		t.Errorf("read %v", records)
+	}
+	if !records[0].Time.Equal(now.Add(4 * time.Second)) {
+		t.Errorf("time %v", records[0].Time)
+	}
+	records, err = s.Read("t", 11, 10)
+	if err != nil || len(records) != 0 {
+		t.Errorf("read %v, %v past the end", records, err)
+	}
+	records, err = s.Read("other", 1, 10)
+	if err != nil || len(records) != 0 {
+		t.Errorf("read %v, %v from empty topic", records, err)
+	}
+	info, err := s.Info("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.First != 1 || info.Next != 11 || info.Bytes != 11 {
+		t.Errorf("info %+v", info)
+	}
+	topics, err := s.Topics()
+	if err != nil || len(topics) != 1 || topics[0] != "t" {
+		t.Errorf("topics %v, %v", topics, err)
+	}
+
+	err = s.Truncate("t", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = s.Read("t", 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || records[0].Seq > 5 || records[len(records)-1].Seq != 10 {
+		t.Errorf("read %v after truncation", records)
+	}
+	seq, err := s.Append("t", nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 11 {
+		t.Errorf("appended as %d after truncation", seq)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	s := NewMemory()
+	testStore(t, s)
+	records, _ := s.Read("t", 1, 100)
+	if records[0].Seq != 5 {
+		t.Errorf("truncated to %d", records[0].Seq)
+	}
+	if s.Close() != nil || s.Close() != ErrClosed {
+		t.Error("closed twice")
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	// Every record gets a segment of its own
+	l, err := OpenLog(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, l)
+	records, _ := l.Read("t", 1, 100)
+	if records[0].Seq != 5 {
+		t.Errorf("truncated to %d", records[0].Seq)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLog(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := l.Info("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.First != 5 || info.Next != 12 {
+		t.Errorf("info %+v after reopening", info)
+	}
+	seq, err := l.Append("t", []byte("x"), time.Now())
+	if err != nil || seq != 12 {
+		t.Errorf("appended as %d, %v after reopening", seq, err)
+	}
+}
+
+func TestLogTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLog(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append("t", []byte("hello"), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// Cut the last record short
+	path := filepath.Join(dir, "74", fmt.Sprintf("%020d.log", 1))
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, stat.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLog(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, _ := l.Info("t")
+	if info.Next != 3 {
+		t.Errorf("info %+v, expected the last record to be gone", info)
+	}
+	seq, err := l.Append("t", []byte("again"), time.Now())
+	if err != nil || seq != 3 {
+		t.Fatalf("appended as %d, %v", seq, err)
+	}
+	records, err := l.Read("t", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || string(records[2].Data) != "again" {
+		t.Errorf("read %v", records)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s := NewMemory()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		s.Append("t", make([]byte, 10), now.Add(time.Duration(i-10)*time.Minute))
+	}
+	err := Retention{MaxAge: 5 * time.Minute}.Enforce(s, "t", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := s.Info("t")
+	if info.First != 6 {
+		t.Errorf("kept from %d, expected 6", info.First)
+	}
+	err = Retention{MaxBytes: 25}.Enforce(s, "t", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ = s.Info("t")
+	if info.First != 9 || info.Bytes != 20 {
+		t.Errorf("info %+v", info)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	s, err := OpenLog(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	// A topic that never fills its first segment
+	for i := 0; i < 3; i++ {
+		s.Append("t", make([]byte, 10), now.Add(time.Duration(i-10)*time.Minute))
+	}
+	s.Append("t", make([]byte, 10), now)
+	r := Retention{MaxAge: 5 * time.Minute}
+	err = r.Enforce(s, "t", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the rest expires too, the segment goes
+	err = r.Enforce(s, "t", now.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := s.Info("t")
+	if info.First != 5 || info.Next != 5 || info.Bytes != 0 {
+		t.Errorf("info %+v", info)
+	}
+	records, err := s.Read("t", 1, 10)
+	if err != nil || len(records) != 0 {
+		t.Errorf("read %v, %v after expiry", records, err)
+	}
+}
+
+func TestLogEmptyTopic(t *testing.T) {
+	dir := t.TempDir()
+	// Left behind by a crash before the first segment was created
+	err := os.Mkdir(filepath.Join(dir, hex.EncodeToString([]byte("t"))), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenLog(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Truncate("t", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Retention{MaxAge: time.Minute, MaxBytes: 10}.Enforce(s, "t", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := s.Append("t", []byte("a"), time.Now())
+	if err != nil || seq != 1 {
+		t.Errorf("appended as %d, %v", seq, err)
+	}
+}
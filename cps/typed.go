@@ -0,0 +1,182 @@
+package cps
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jakobvarmose/everything/cps/frame"
+)
+
+// Codec turns values into payloads and back.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+	// MessagePack encodes values as MessagePack. Values are mapped the way
+	// encoding/json maps them, so struct tags and custom JSON marshalers
+	// apply.
+	MessagePack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(buf))
+	d.UseNumber()
+	var generic interface{}
+	err = d.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+	return frame.Marshal(fromJSON(generic))
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	generic, err := frame.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	// Binary data becomes base64, which is what encoding/json expects for
+	// byte slices
+	buf, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// fromJSON replaces the numbers in a value decoded by encoding/json with
+// integers where possible, so they are encoded compactly.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = fromJSON(v[key])
+		}
+	}
+	return v
+}
+
+// DecodeError is reported by Typed for a message whose payload couldn't be
+// decoded.
+type DecodeError struct {
+	Message *Message
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding message on %s: %s", e.Message.Topic, e.Err.Error())
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Typed decodes the payloads of a subscription into values of type T.
+type Typed[T any] struct {
+	sub   *Subscription
+	codec Codec
+	c     chan T
+	errs  chan error
+	once  sync.Once
+}
+
+// NewTyped decodes the messages of sub with codec. Messages received
+// through a group are acknowledged once their value has been received from
+// C, or once they have failed to decode. Those that are still waiting for
+// C when the subscription ends go to another member of the group.
+func NewTyped[T any](sub *Subscription, codec Codec) *Typed[T] {
+	return &Typed[T]{
+		sub:   sub,
+		codec: codec,
+		c:     make(chan T),
+		errs:  make(chan error, 16),
+	}
+}
+
+func (t *Typed[T]) run() {
+	defer close(t.c)
+	defer close(t.errs)
+	for msg := range t.sub.C() {
+		var v T
+		err := t.codec.Unmarshal(msg.Data, &v)
+		if err != nil {
+			// It won't decode anywhere else either
+			msg.Ack()
+			select {
+			case t.errs <- &DecodeError{&msg, err}:
+			default:
+				// Nobody is listening
+			}
+			continue
+		}
+		select {
+		case t.c <- v:
+			msg.Ack()
+		case <-t.sub.done:
+			return
+		case <-t.sub.c.done:
+			return
+		}
+	}
+}
+
+func (t *Typed[T]) start() {
+	t.once.Do(func() {
+		go t.run()
+	})
+}
+
+// C returns a channel that receives the decoded values. It is closed when
+// the subscription is canceled or the connection ends.
+func (t *Typed[T]) C() <-chan T {
+	t.start()
+	return t.c
+}
+
+// Errors returns a channel that receives a DecodeError for every message
+// that couldn't be decoded. Errors are discarded while the channel is full.
+func (t *Typed[T]) Errors() <-chan error {
+	t.start()
+	return t.errs
+}
+
+// Subscription returns the underlying subscription.
+func (t *Typed[T]) Subscription() *Subscription {
+	return t.sub
+}
+
+// Cancel cancels the underlying subscription.
+func (t *Typed[T]) Cancel() {
+	t.sub.Cancel()
+}
@@ -0,0 +1,487 @@
+package infostore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"sync"
+
+	"github.com/jakobvarmose/dc/crypto"
+)
+
+var (
+	ErrorNotFound  = errors.New("Not Found")
+	ErrorBadCursor = errors.New("Bad Cursor")
+
+	// ErrBadSignature is returned by Put for records whose signature
+	// doesn't match their pubkey and data.
+	ErrBadSignature = errors.New("bad signature")
+	// ErrMalformedInfo is returned by Put for records whose data isn't an
+	// Info.
+	ErrMalformedInfo = errors.New("malformed info")
+)
+
+type InfoStore struct {
+	backend Backend
+	// index is nil if the store has no secondary indexes
+	index *index
+
+	// locks serialize the updates of a record, see lock
+	locks [lockStripes]sync.Mutex
+
+	listeners   []*subscriber
+	listenersLk sync.Mutex
+	readers     []*Reader
+	readersLk   sync.Mutex
+}
+
+// Key identifies a record. Keys are ordered by page, then creator, then
+// number.
+type Key struct {
+	Page    []byte
+	Creator []byte
+	Number  int64
+}
+
+func compareKeys(a, b Key) int {
+	if c := bytes.Compare(a.Page, b.Page); c != 0 {
+		return c
+	}
+	if c := bytes.Compare(a.Creator, b.Creator); c != 0 {
+		return c
+	}
+	switch {
+	case a.Number < b.Number:
+		return -1
+	case a.Number > b.Number:
+		return 1
+	}
+	return 0
+}
+
+// next returns the smallest key after k.
+func (k Key) next() Key {
+	if k.Number == math.MaxInt64 {
+		return Key{k.Page, append(append([]byte(nil), k.Creator...), 0), math.MinInt64}
+	}
+	return Key{k.Page, k.Creator, k.Number + 1}
+}
+
+// Backend stores the marshaled records of an InfoStore. It must be safe for
+// concurrent use, but the InfoStore never updates the same key from two
+// goroutines at once.
+type Backend interface {
+	// Get returns the record with key k, or ErrorNotFound.
+	Get(k Key) ([]byte, error)
+	// Put adds or replaces the record with key k.
+	Put(k Key, data []byte) error
+	// Delete removes the record with key k, or returns ErrorNotFound.
+	Delete(k Key) error
+	// List calls fn in key order for the records with keys from from on,
+	// until fn returns false. fn may call the other methods.
+	List(from Key, fn func(k Key, data []byte) bool) error
+	Close() error
+}
+
+// BatchOp is a change made by Batcher.Batch: a Put of Data to Key, or a
+// Delete of Key if Delete is set.
+type BatchOp struct {
+	Key    Key
+	Data   []byte
+	Delete bool
+}
+
+// Batcher is implemented by backends that can make several changes at
+// once, such that a crash leaves either all or none of them. Deleting a key
+// that isn't there is not an error in a batch.
+type Batcher interface {
+	Batch(ops []BatchOp) error
+}
+
+// ReverseLister is implemented by backends that can list records backwards,
+// so the last records of a range are found without walking the others.
+type ReverseLister interface {
+	// ListReverse calls fn in reverse key order for the records with keys
+	// up to and including to, until fn returns false. fn may call the
+	// other methods.
+	ListReverse(to Key, fn func(k Key, data []byte) bool) error
+}
+
+// NewInfoStore returns a store that keeps its records in dir, see
+// DirBackend, with secondary indexes in a file next to them.
+func NewInfoStore(dir string) (*InfoStore, error) {
+	b, err := NewDirBackend(dir)
+	if err != nil {
+		return nil, err
+	}
+	ib, err := NewLogBackend(path.Join(dir, indexFile))
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	is := NewInfoStoreWithBackend(b, WithIndex(ib))
+	// The index is stale in a directory from before the index, and after a
+	// crash
+	err = is.index.ready()
+	if err == ErrorIndexStale {
+		err = is.RebuildIndex()
+	}
+	if err != nil {
+		is.Close()
+		return nil, err
+	}
+	return is, nil
+}
+
+// indexFile is the file in the directory of a store that holds the
+// secondary indexes, in a LogBackend.
+const indexFile = "index.log"
+
+func NewInfoStoreWithBackend(b Backend, opts ...StoreOption) *InfoStore {
+	is := &InfoStore{
+		backend: b,
+	}
+	for _, opt := range opts {
+		opt(is)
+	}
+	// Before any record is put, which would make a new index look stale
+	if is.index != nil && is.index.load() != nil {
+		is.index.stale = true
+	}
+	return is
+}
+
+// Close stops the listeners and closes the backends. The index is only
+// marked as complete by Close, see RebuildIndex.
+func (is *InfoStore) Close() error {
+	is.unlistenAll()
+	err := is.backend.Close()
+	if is.index != nil {
+		if indexErr := is.index.close(); err == nil {
+			err = indexErr
+		}
+	}
+	return err
+}
+
+// lockStripes is the number of locks the records are spread over.
+const lockStripes = 64
+
+// lock returns the lock that guards the record of page, creator and number.
+// Records share locks, but the same record always gets the same one.
+func (is *InfoStore) lock(page []byte, creator []byte, number int64) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(page)
+	h.Write([]byte{0})
+	h.Write(creator)
+	binary.Write(h, binary.BigEndian, number)
+	return &is.locks[h.Sum32()%lockStripes]
+}
+
+// Get returns the record of page, creator and number, or ErrorNotFound if
+// there is none or it has been deleted.
+func (is *InfoStore) Get(page []byte, creator []byte, number int64) (*crypto.Signed, error) {
+	data, err := is.backend.Get(Key{page, creator, number})
+	if err != nil {
+		return nil, err
+	}
+	signed, err := crypto.UnmarshalSigned(data)
+	if err != nil {
+		return nil, err
+	}
+	if isTombstone(signed.Data) {
+		return nil, ErrorNotFound
+	}
+	return signed, nil
+}
+
+// PutOption changes how Put treats a record.
+type PutOption func(*putOptions)
+
+type putOptions struct {
+	trusted bool
+}
+
+// Trusted skips the verification of the signature, for records that come
+// from a trusted source, like an import of a local backup.
+func Trusted() PutOption {
+	return func(o *putOptions) {
+		o.trusted = true
+	}
+}
+
+// Put stores signed, which holds either an Info or a Tombstone, unless a
+// newer version of the record is already stored, see version. The signature
+// is verified first, unless the Trusted option is given, returning
+// ErrBadSignature if it is invalid. Once the record is stored, Put succeeds
+// even if the secondary indexes can't be updated; they are stale then, see
+// ErrorIndexStale.
+func (is *InfoStore) Put(signed *crypto.Signed, opts ...PutOption) error {
+	var o putOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.trusted && !signed.Verify() {
+		return ErrBadSignature
+	}
+	rec, err := parseRecord(signed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedInfo, err)
+	}
+	key := rec.key()
+	data := signed.Marshal()
+
+	// Compare and write without another Put getting in between
+	lk := is.lock(key.Page, key.Creator, key.Number)
+	lk.Lock()
+	defer lk.Unlock()
+
+	e := Event{
+		Page:      key.Page,
+		Creator:   key.Creator,
+		Number:    key.Number,
+		Info:      rec.info,
+		Tombstone: rec.tombstone,
+	}
+	oldData, err := is.backend.Get(key)
+	if err == nil {
+		old, err := unmarshalRecord(oldData)
+		if err == nil {
+			if !rec.version().newer(old.version()) {
+				return nil
+			}
+			e.HasPrevious = true
+			e.PreviousRevision = old.version().Revision
+		}
+	} else if err != ErrorNotFound {
+		return err
+	}
+	if err := is.backend.Put(key, data); err != nil {
+		return err
+	}
+
+	if is.index != nil {
+		// The record is stored, so a failure only makes the index stale
+		is.index.update(key, rec.info != nil)
+	}
+
+	if rec.info != nil {
+		is.add(key.Creator, rec.info)
+	}
+	is.notify(e)
+
+	return nil
+}
+
+// newer reports whether info replaces old, see version.
+func newer(info, old *Info) bool {
+	return version{Revision: info.Revision, Hash: info.Hash}.newer(version{Revision: old.Revision, Hash: old.Hash})
+}
+
+// Delete removes the record of page, creator and number outright. Unlike
+// putting a Tombstone, this doesn't keep a peer from putting the record
+// again.
+func (is *InfoStore) Delete(page []byte, creator []byte, number int64) error {
+	lk := is.lock(page, creator, number)
+	lk.Lock()
+	defer lk.Unlock()
+
+	key := Key{page, creator, number}
+	e := Event{
+		Page:    page,
+		Creator: creator,
+		Number:  number,
+	}
+	if oldData, err := is.backend.Get(key); err == nil {
+		if old, err := unmarshalRecord(oldData); err == nil {
+			e.HasPrevious = true
+			e.PreviousRevision = old.version().Revision
+		}
+	}
+	if err := is.backend.Delete(key); err != nil {
+		return err
+	}
+	if is.index != nil {
+		is.index.update(key, false)
+	}
+	is.notify(e)
+
+	return nil
+}
+
+// Subject returns a Reader that receives the infos stored for page,
+// followed by those put later. An info is only received again if it is
+// replaced by a newer one. The reader must be closed when no longer
+// needed.
+func (is *InfoStore) Subject(page []byte) *Reader {
+	r := &Reader{
+		infos:  is,
+		page:   page,
+		Ch:     make(chan *Info),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		latest: make(map[string]*Info),
+	}
+	// Register first, so infos put while the stored ones are read aren't
+	// missed
+	is.readersLk.Lock()
+	is.readers = append(is.readers, r)
+	is.readersLk.Unlock()
+	go r.run()
+	return r
+}
+
+// Reader streams the infos of a page, see Subject. Ch is closed when the
+// reader is closed or fails, in which case Err tells why.
+type Reader struct {
+	infos *InfoStore
+	page  []byte
+	Ch    chan *Info
+
+	mutex sync.Mutex
+	// latest holds the newest info seen for every creator and number
+	latest map[string]*Info
+	// queue holds the infos put since the reader was created
+	queue []*Info
+	wake  chan struct{}
+	err   error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *Reader) run() {
+	defer close(r.Ch)
+	err := r.replay()
+	if err != nil {
+		r.mutex.Lock()
+		r.err = err
+		r.mutex.Unlock()
+		return
+	}
+	for {
+		r.mutex.Lock()
+		queue := r.queue
+		r.queue = nil
+		r.mutex.Unlock()
+		for _, info := range queue {
+			if !r.send(info) {
+				return
+			}
+		}
+		select {
+		case <-r.wake:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// replay sends the stored infos.
+func (r *Reader) replay() error {
+	var err error
+	listErr := r.infos.backend.List(Key{r.page, nil, math.MinInt64}, func(k Key, data []byte) bool {
+		if !bytes.Equal(k.Page, r.page) {
+			return false
+		}
+		var rec *record
+		rec, err = unmarshalRecord(data)
+		if err != nil {
+			err = fmt.Errorf("%x/%d: %w", k.Creator, k.Number, err)
+			return false
+		}
+		if rec.info == nil || !r.see(k.Creator, rec.info) {
+			return true
+		}
+		return r.send(rec.info)
+	})
+	if listErr != nil {
+		return listErr
+	}
+	return err
+}
+
+// see records info and reports whether it is newer than what the reader
+// has seen for the same creator and number.
+func (r *Reader) see(creator []byte, info *Info) bool {
+	key := fmt.Sprintf("%x/%d", creator, info.Number)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if old, ok := r.latest[key]; ok && !newer(info, old) {
+		return false
+	}
+	r.latest[key] = info
+	return true
+}
+
+func (r *Reader) send(info *Info) bool {
+	select {
+	case r.Ch <- info:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// push queues an info that has just been put. It never blocks, so a slow
+// reader doesn't hold up Put.
+func (r *Reader) push(creator []byte, info *Info) {
+	if !r.see(creator, info) {
+		return
+	}
+	r.mutex.Lock()
+	r.queue = append(r.queue, info)
+	r.mutex.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (is *InfoStore) add(creator []byte, info *Info) {
+	is.readersLk.Lock()
+	defer is.readersLk.Unlock()
+	for _, reader := range is.readers {
+		if bytes.Equal(reader.page, info.Page) {
+			reader.push(creator, info)
+		}
+	}
+}
+
+// Close stops the reader. It may be called more than once.
+func (r *Reader) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.infos.readersLk.Lock()
+		defer r.infos.readersLk.Unlock()
+		for i, reader := range r.infos.readers {
+			if r == reader {
+				r.infos.readers = append(r.infos.readers[:i], r.infos.readers[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// Next returns the next info, or nil if ctx is done or the reader has
+// ended.
+func (r *Reader) Next(ctx context.Context) *Info {
+	select {
+	case <-ctx.Done():
+		return nil
+	case info := <-r.Ch:
+		return info
+	}
+}
+
+// Err returns the error that ended the reader, if any.
+func (r *Reader) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
@@ -0,0 +1,597 @@
+package infostore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DirBackend keeps every record in a file of its own, at
+// dir/pageHex/creatorHex/number, with "a" standing in for the empty page.
+// Changes are noted in a journal before they are made, so that after a
+// crash only the records in the journal need to be checked.
+type DirBackend struct {
+	dir string
+
+	mutex   sync.Mutex
+	journal *os.File
+	// journalSize is the size of the journal, and writing the number of
+	// changes under way
+	journalSize int64
+	writing     int
+}
+
+// quarantineDir is where records that can't be read are moved to by
+// Recover. It can't be mistaken for a page, as those are even length hex or
+// "a".
+const quarantineDir = "quarantine"
+
+// journalFile names the records that are being changed, one per line. It
+// is emptied when the store is closed, and whenever it has grown beyond
+// journalMax bytes and no change is under way.
+const journalFile = "journal"
+
+const journalMax = 1 << 20
+
+// NewDirBackend opens the store in dir, creating it if necessary. If the
+// store wasn't closed, the records named in the journal are recovered like
+// Recover does. A store without a journal is recovered as a whole.
+func NewDirBackend(dir string) (*DirBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	b := &DirBackend{
+		dir: dir,
+	}
+	names, err := b.readJournal()
+	if os.IsNotExist(err) {
+		_, err = b.Recover()
+	} else if err == nil {
+		_, err = b.recoverNames(names)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.journal, err = os.OpenFile(path.Join(dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		b.journal.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Recover cleans up after a crash. It removes the temporary files of
+// unfinished writes and the directories left empty by Delete, and moves
+// records that can't be unmarshaled to the quarantine directory, keeping
+// their path. It returns the paths of the quarantined records, relative to
+// the store directory. It reads every record, so NewDirBackend only calls it
+// for a store without a journal. It must not be called while the store is in
+// use.
+func (b *DirBackend) Recover() ([]string, error) {
+	var quarantined []string
+	pages, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		if !page.IsDir() || page.Name() == quarantineDir {
+			continue
+		}
+		creators, err := ioutil.ReadDir(path.Join(b.dir, page.Name()))
+		if err != nil {
+			return quarantined, err
+		}
+		for _, creator := range creators {
+			if !creator.IsDir() {
+				continue
+			}
+			dir := path.Join(page.Name(), creator.Name())
+			files, err := ioutil.ReadDir(path.Join(b.dir, dir))
+			if err != nil {
+				return quarantined, err
+			}
+			for _, file := range files {
+				name := path.Join(dir, file.Name())
+				if isTemp(file.Name()) {
+					if err := os.Remove(path.Join(b.dir, name)); err != nil {
+						return quarantined, err
+					}
+					continue
+				}
+				ok, err := b.check(name)
+				if err != nil {
+					return quarantined, err
+				}
+				if !ok {
+					quarantined = append(quarantined, name)
+				}
+			}
+			if err := removeEmpty(path.Join(b.dir, dir)); err != nil {
+				return quarantined, err
+			}
+		}
+		if err := removeEmpty(path.Join(b.dir, page.Name())); err != nil {
+			return quarantined, err
+		}
+	}
+	return quarantined, nil
+}
+
+// recoverNames does what Recover does, for the records with the given names
+// and the directories they are in only.
+func (b *DirBackend) recoverNames(names []string) ([]string, error) {
+	var quarantined []string
+	for _, dir := range recordDirs(names) {
+		files, err := ioutil.ReadDir(path.Join(b.dir, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return quarantined, err
+		}
+		for _, file := range files {
+			if isTemp(file.Name()) {
+				if err := os.Remove(path.Join(b.dir, dir, file.Name())); err != nil {
+					return quarantined, err
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		ok, err := b.check(name)
+		if err != nil {
+			return quarantined, err
+		}
+		if !ok {
+			quarantined = append(quarantined, name)
+		}
+	}
+	return quarantined, b.tidy(names)
+}
+
+// check quarantines the record at name if it doesn't unmarshal, and reports
+// whether it was left in place. A missing record is fine.
+func (b *DirBackend) check(name string) (bool, error) {
+	if _, err := os.Stat(path.Join(b.dir, name)); os.IsNotExist(err) {
+		return true, nil
+	}
+	if b.readable(name) {
+		return true, nil
+	}
+	return false, b.quarantine(name)
+}
+
+// tidy removes the directories of the records with the given names that
+// are empty.
+func (b *DirBackend) tidy(names []string) error {
+	for _, dir := range recordDirs(names) {
+		for _, d := range []string{dir, path.Dir(dir)} {
+			err := removeEmpty(path.Join(b.dir, d))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordDirs returns the directories of the records with the given names.
+func recordDirs(names []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, name := range names {
+		dir := path.Dir(name)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// readJournal returns the names of the records in the journal. Lines that
+// aren't record names, such as one torn by a crash, are skipped.
+func (b *DirBackend) readJournal() ([]string, error) {
+	data, err := ioutil.ReadFile(path.Join(b.dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.Split(string(data), "\n") {
+		if seen[name] || !isRecordName(name) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// isRecordName reports whether name looks like page/creator/number.
+func isRecordName(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] == quarantineDir {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// begin notes in the journal that the record with key k is about to
+// change. done must be called once it has.
+func (b *DirBackend) begin(k Key) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.journal == nil {
+		return ErrorClosed
+	}
+	line := b.name(k) + "\n"
+	_, err := b.journal.WriteString(line)
+	if err == nil {
+		err = b.journal.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	b.journalSize += int64(len(line))
+	b.writing++
+	return nil
+}
+
+// done empties the journal once it is large enough, if no other change is
+// under way. The change is already made, so failures are only reported.
+func (b *DirBackend) done() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.writing--
+	if b.writing > 0 || b.journalSize < journalMax {
+		return
+	}
+	if err := b.emptyJournal(); err != nil {
+		fmt.Fprintf(os.Stderr, "emptying journal of %s: %v\n", b.dir, err)
+	}
+}
+
+// emptyJournal removes the directories that Delete left empty and empties
+// the journal. No change may be under way.
+func (b *DirBackend) emptyJournal() error {
+	names, err := b.readJournal()
+	if err != nil {
+		return err
+	}
+	if err := b.tidy(names); err != nil {
+		return err
+	}
+	if err := b.journal.Truncate(0); err != nil {
+		return err
+	}
+	b.journalSize = 0
+	return b.journal.Sync()
+}
+
+// removeEmpty removes dir if it is empty.
+func removeEmpty(dir string) error {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil || len(names) > 0 {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+// readable reports whether the record at name unmarshals.
+func (b *DirBackend) readable(name string) bool {
+	data, err := ioutil.ReadFile(path.Join(b.dir, name))
+	if err != nil {
+		return false
+	}
+	_, err = unmarshalRecord(data)
+	return err == nil
+}
+
+func (b *DirBackend) quarantine(name string) error {
+	to := path.Join(b.dir, quarantineDir, name)
+	if err := os.MkdirAll(path.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(b.dir, name), to)
+}
+
+// tempPrefix starts the names of files that are being written.
+const tempPrefix = ".tmp-"
+
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// writeFile replaces the file at name with data, such that a crash leaves
+// either the old or the new content. The data is written to a temporary
+// file in the same directory, which is synced and renamed over the old
+// file, after which the directory is synced too.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	dir := path.Dir(name)
+	f, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func pageName(page []byte) string {
+	pageHex := fmt.Sprintf("%x", page)
+	if pageHex == "" {
+		pageHex = "a"
+	}
+	return pageHex
+}
+
+// name returns the path of the record with key k, relative to the store
+// directory.
+func (b *DirBackend) name(k Key) string {
+	return path.Join(pageName(k.Page), fmt.Sprintf("%x", k.Creator), fmt.Sprintf("%d", k.Number))
+}
+
+func (b *DirBackend) path(k Key) string {
+	return path.Join(b.dir, b.name(k))
+}
+
+func (b *DirBackend) Get(k Key) ([]byte, error) {
+	data, err := ioutil.ReadFile(b.path(k))
+	if os.IsNotExist(err) {
+		return nil, ErrorNotFound
+	}
+	return data, err
+}
+
+func (b *DirBackend) Put(k Key, data []byte) error {
+	if err := b.begin(k); err != nil {
+		return err
+	}
+	defer b.done()
+	pageDir := path.Join(b.dir, pageName(k.Page))
+	creatorDir := path.Join(pageDir, fmt.Sprintf("%x", k.Creator))
+	if _, err := os.Stat(creatorDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(creatorDir, 0755); err != nil {
+			return err
+		}
+		// Make the new directories last
+		if err := syncDir(pageDir); err != nil {
+			return err
+		}
+		if err := syncDir(b.dir); err != nil {
+			return err
+		}
+	}
+	return writeFile(b.path(k), data, 0644)
+}
+
+func (b *DirBackend) Delete(k Key) error {
+	if err := b.begin(k); err != nil {
+		return err
+	}
+	defer b.done()
+	name := b.path(k)
+	err := os.Remove(name)
+	if os.IsNotExist(err) {
+		return ErrorNotFound
+	}
+	// The directories are kept, as a Put into them may be under way. They
+	// are removed once empty when the journal is emptied.
+	return err
+}
+
+// List walks the directories in key order. Hex encoding keeps the order of
+// the bytes, but the names are decoded and sorted anyway, as the empty page
+// is named "a" and numbers are decimal.
+func (b *DirBackend) List(from Key, fn func(k Key, data []byte) bool) error {
+	pages, err := readNames(b.dir, decodePage)
+	if err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if bytes.Compare(page.key, from.Page) < 0 {
+			continue
+		}
+		pageDir := path.Join(b.dir, page.name)
+		creators, err := readNames(pageDir, hex.DecodeString)
+		if err != nil {
+			return err
+		}
+		for _, creator := range creators {
+			k := Key{page.key, creator.key, 0}
+			if bytes.Equal(k.Page, from.Page) && bytes.Compare(k.Creator, from.Creator) < 0 {
+				continue
+			}
+			numbers, err := readNumbers(path.Join(pageDir, creator.name))
+			if err != nil {
+				return err
+			}
+			for _, number := range numbers {
+				k.Number = number
+				if compareKeys(k, from) < 0 {
+					continue
+				}
+				data, err := ioutil.ReadFile(path.Join(pageDir, creator.name, strconv.FormatInt(number, 10)))
+				if os.IsNotExist(err) {
+					// Deleted meanwhile
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !fn(k, data) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ListReverse walks the directories like List, backwards.
+func (b *DirBackend) ListReverse(to Key, fn func(k Key, data []byte) bool) error {
+	pages, err := readNames(b.dir, decodePage)
+	if err != nil {
+		return err
+	}
+	for i := len(pages) - 1; i >= 0; i-- {
+		page := pages[i]
+		if bytes.Compare(page.key, to.Page) > 0 {
+			continue
+		}
+		pageDir := path.Join(b.dir, page.name)
+		creators, err := readNames(pageDir, hex.DecodeString)
+		if err != nil {
+			return err
+		}
+		for j := len(creators) - 1; j >= 0; j-- {
+			creator := creators[j]
+			k := Key{page.key, creator.key, 0}
+			if bytes.Equal(k.Page, to.Page) && bytes.Compare(k.Creator, to.Creator) > 0 {
+				continue
+			}
+			numbers, err := readNumbers(path.Join(pageDir, creator.name))
+			if err != nil {
+				return err
+			}
+			for m := len(numbers) - 1; m >= 0; m-- {
+				k.Number = numbers[m]
+				if compareKeys(k, to) > 0 {
+					continue
+				}
+				data, err := ioutil.ReadFile(path.Join(pageDir, creator.name, strconv.FormatInt(k.Number, 10)))
+				if os.IsNotExist(err) {
+					// Deleted meanwhile
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !fn(k, data) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Close empties the journal, see journalFile. It must not be called while
+// the store is in use.
+func (b *DirBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.journal == nil {
+		return ErrorClosed
+	}
+	err := b.emptyJournal()
+	if closeErr := b.journal.Close(); err == nil {
+		err = closeErr
+	}
+	b.journal = nil
+	return err
+}
+
+type dirName struct {
+	name string
+	key  []byte
+}
+
+func decodePage(name string) ([]byte, error) {
+	if name == "a" {
+		return []byte{}, nil
+	}
+	return hex.DecodeString(name)
+}
+
+// readNames returns the names of the directories in dir that decode, in
+// the order of the decoded names. A directory that doesn't exist is empty.
+func readNames(dir string, decode func(string) ([]byte, error)) ([]dirName, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []dirName
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		key, err := decode(entry.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, dirName{entry.Name(), key})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return bytes.Compare(names[i].key, names[j].key) < 0
+	})
+	return names, nil
+}
+
+// readNumbers returns the numbers of the records in dir, sorted.
+func readNumbers(dir string) ([]int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int64
+	for _, entry := range entries {
+		number, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			// Temporary files among others
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+	return numbers, nil
+}
@@ -0,0 +1,157 @@
+package infostore
+
+import (
+	"sync"
+)
+
+// Event describes a change of a record.
+type Event struct {
+	Page    []byte
+	Creator []byte
+	Number  int64
+	// Info is the info that was put, or nil for a deletion.
+	Info *Info
+	// Tombstone is the tombstone that was put, if the record was deleted
+	// with one.
+	Tombstone *Tombstone
+	// HasPrevious is set if the record replaced or deleted another one, in
+	// which case PreviousRevision is its revision.
+	HasPrevious      bool
+	PreviousRevision int64
+}
+
+// Listener is told about the changes of the records of an InfoStore. Every
+// listener has a queue of its own, from which a goroutine of its own calls
+// it, so a slow listener only holds up itself, and it may call Unlisten.
+type Listener interface {
+	InfoAdded(e Event)
+	InfoDeleted(e Event)
+	// EventsDropped is called when n events were dropped because the queue
+	// was full. The listener must read the store to catch up.
+	EventsDropped(n int)
+}
+
+// DefaultQueueSize is the number of events a listener's queue holds, unless
+// set with QueueSize.
+const DefaultQueueSize = 1024
+
+// ListenOption changes how events are delivered to a listener.
+type ListenOption func(*subscriber)
+
+// QueueSize sets the number of events the listener's queue holds. Events
+// that arrive while it is full are dropped, see Listener.EventsDropped.
+func QueueSize(n int) ListenOption {
+	return func(s *subscriber) {
+		s.size = n
+	}
+}
+
+type subscriber struct {
+	listener Listener
+	size     int
+
+	mutex   sync.Mutex
+	queue   []Event
+	dropped int
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// push queues e without blocking.
+func (s *subscriber) push(e Event) {
+	s.mutex.Lock()
+	if len(s.queue) < s.size {
+		s.queue = append(s.queue, e)
+	} else {
+		s.dropped++
+	}
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		s.mutex.Lock()
+		queue := s.queue
+		dropped := s.dropped
+		s.queue = nil
+		s.dropped = 0
+		s.mutex.Unlock()
+		for _, e := range queue {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if e.Info != nil {
+				s.listener.InfoAdded(e)
+			} else {
+				s.listener.InfoDeleted(e)
+			}
+		}
+		// The dropped events came after the queued ones
+		if dropped > 0 {
+			s.listener.EventsDropped(dropped)
+		}
+	}
+}
+
+// Listen starts telling l about the changes of the records, until Unlisten
+// or Close is called.
+func (is *InfoStore) Listen(l Listener, opts ...ListenOption) {
+	s := &subscriber{
+		listener: l,
+		size:     DefaultQueueSize,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	is.listenersLk.Lock()
+	defer is.listenersLk.Unlock()
+	is.listeners = append(is.listeners, s)
+	go s.run()
+}
+
+// Unlisten stops telling l about changes. Events that are still queued are
+// dropped, but a call of l that is in progress isn't waited for.
+func (is *InfoStore) Unlisten(l Listener) {
+	is.listenersLk.Lock()
+	defer is.listenersLk.Unlock()
+	for i, s := range is.listeners {
+		if l == s.listener {
+			close(s.done)
+			is.listeners[i] = is.listeners[len(is.listeners)-1]
+			is.listeners = is.listeners[:len(is.listeners)-1]
+			break
+		}
+	}
+}
+
+// unlistenAll stops all listeners.
+func (is *InfoStore) unlistenAll() {
+	is.listenersLk.Lock()
+	defer is.listenersLk.Unlock()
+	for _, s := range is.listeners {
+		close(s.done)
+	}
+	is.listeners = nil
+}
+
+// notify queues e for every listener.
+func (is *InfoStore) notify(e Event) {
+	is.listenersLk.Lock()
+	defer is.listenersLk.Unlock()
+	for _, s := range is.listeners {
+		s.push(e)
+	}
+}
@@ -0,0 +1,480 @@
+package infostore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+var (
+	// ErrorNoIndex is returned by the iterators of a store without an
+	// index.
+	ErrorNoIndex = errors.New("No Index")
+	// ErrorIndexStale is returned by the iterators when the index may miss
+	// changes, because the store wasn't closed or an update of the index
+	// failed. RebuildIndex makes it usable again.
+	ErrorIndexStale = errors.New("Index Stale")
+)
+
+// An index keeps the secondary indexes of a store as records of a Backend
+// of its own, using keys of these kinds:
+//
+//	"c"+creator, page, number: the record of creator for page and number
+//	"r"+page, creator, number: the sequence number of the last change of the
+//	                           record, as the data
+//	"s", nil, seq:             the record with sequence number seq, as the
+//	                           data
+//	"m", nil, 0:               present while the store is closed and the
+//	                           index is complete
+//
+// Every change of a record gets the next sequence number, replacing the
+// one of its previous change. The changes of the index for a change of a
+// record are made in one batch if the backend is a Batcher.
+//
+// The index is updated after the record, so a crash in between leaves it
+// incomplete. That's why the "m" record is removed when the store is set up,
+// and only put back by Close: if it is missing, the index is stale.
+type index struct {
+	backend Backend
+	// records is the backend of the store
+	records Backend
+
+	mutex  sync.Mutex
+	seq    int64
+	loaded bool
+	stale  bool
+}
+
+const (
+	indexCreator = 'c'
+	indexRecord  = 'r'
+	indexSeq     = 's'
+	indexClosed  = 'm'
+)
+
+var closedKey = Key{[]byte{indexClosed}, nil, 0}
+
+// StoreOption changes how a store is set up.
+type StoreOption func(*InfoStore)
+
+// WithIndex keeps secondary indexes in b, see ByCreator and ChangesSince.
+// If the index turns out to be stale, as when it is new for a store that
+// already holds records, RebuildIndex must be called.
+func WithIndex(b Backend) StoreOption {
+	return func(is *InfoStore) {
+		is.index = &index{
+			backend: b,
+			records: is.backend,
+		}
+	}
+}
+
+// load checks whether the index is complete, and finds the last sequence
+// number, when the store is set up.
+func (x *index) load() error {
+	if x.loaded {
+		return nil
+	}
+	_, err := x.backend.Get(closedKey)
+	switch err {
+	case nil:
+		if err := x.backend.Delete(closedKey); err != nil {
+			return err
+		}
+	case ErrorNotFound:
+		// Only a new index for a new store is complete without the record
+		empty, err := isEmpty(x.backend)
+		if err == nil && empty {
+			empty, err = isEmpty(x.records)
+		}
+		if err != nil {
+			return err
+		}
+		x.stale = x.stale || !empty
+	default:
+		return err
+	}
+	x.seq, err = x.lastSeq()
+	if err != nil {
+		return err
+	}
+	x.loaded = true
+	return nil
+}
+
+func isEmpty(b Backend) (bool, error) {
+	empty := true
+	err := b.List(Key{Number: math.MinInt64}, func(Key, []byte) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// ready returns the error the iterators fail with, if any.
+func (x *index) ready() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	if x.stale {
+		return ErrorIndexStale
+	}
+	return nil
+}
+
+// apply makes the changes in one batch if the backend supports it.
+func (x *index) apply(ops []BatchOp) error {
+	if b, ok := x.backend.(Batcher); ok {
+		return b.Batch(ops)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = x.backend.Delete(op.Key)
+			if err == ErrorNotFound {
+				err = nil
+			}
+		} else {
+			err = x.backend.Put(op.Key, op.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close marks the index as complete, unless it is stale.
+func (x *index) close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.loaded && !x.stale {
+		if err := x.backend.Put(closedKey, nil); err != nil {
+			return err
+		}
+	}
+	return x.backend.Close()
+}
+
+func prefixed(kind byte, b []byte) []byte {
+	return append([]byte{kind}, b...)
+}
+
+func marshalKey(k Key) []byte {
+	var buf []byte
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(k.Page)))
+	buf = append(buf, k.Page...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(k.Creator)))
+	buf = append(buf, k.Creator...)
+	return binary.BigEndian.AppendUint64(buf, uint64(k.Number))
+}
+
+var errBadIndexKey = errors.New("bad key in index")
+
+func unmarshalKey(buf []byte) (Key, error) {
+	var k Key
+	for _, field := range []*[]byte{&k.Page, &k.Creator} {
+		if len(buf) < 4 {
+			return Key{}, errBadIndexKey
+		}
+		n := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint64(len(buf)) < uint64(n) {
+			return Key{}, errBadIndexKey
+		}
+		*field = append([]byte{}, buf[:n]...)
+		buf = buf[n:]
+	}
+	if len(buf) != 8 {
+		return Key{}, errBadIndexKey
+	}
+	k.Number = int64(binary.BigEndian.Uint64(buf))
+	return k, nil
+}
+
+// changeOps returns the changes of the index for a change of the record at
+// k, which is deleted unless live is set, with sequence number seq. The
+// last change of the record had sequence number old, if any.
+func changeOps(k Key, live bool, seq int64, old int64, hasOld bool) []BatchOp {
+	var ops []BatchOp
+	if hasOld {
+		ops = append(ops, BatchOp{Key: Key{[]byte{indexSeq}, nil, old}, Delete: true})
+	}
+	ops = append(ops,
+		BatchOp{Key: Key{[]byte{indexSeq}, nil, seq}, Data: marshalKey(k)},
+		BatchOp{Key: Key{prefixed(indexRecord, k.Page), k.Creator, k.Number}, Data: binary.BigEndian.AppendUint64(nil, uint64(seq))},
+		BatchOp{Key: Key{prefixed(indexCreator, k.Creator), k.Page, k.Number}, Delete: !live},
+	)
+	return ops
+}
+
+// update records a change of the record at k, which is deleted unless live
+// is set. If it fails, the index is stale.
+func (x *index) update(k Key, live bool) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if err := x.load(); err != nil {
+		x.stale = true
+		return err
+	}
+	if x.stale {
+		// RebuildIndex will see the change
+		return nil
+	}
+	data, err := x.backend.Get(Key{prefixed(indexRecord, k.Page), k.Creator, k.Number})
+	if err != nil && err != ErrorNotFound {
+		x.stale = true
+		return err
+	}
+	var old int64
+	hasOld := err == nil && len(data) == 8
+	if hasOld {
+		old = int64(binary.BigEndian.Uint64(data))
+	}
+	if err := x.apply(changeOps(k, live, x.seq+1, old, hasOld)); err != nil {
+		x.stale = true
+		return err
+	}
+	x.seq++
+	return nil
+}
+
+// rebuildBatch is the number of changes RebuildIndex makes in one batch.
+const rebuildBatch = 1000
+
+// RebuildIndex builds the secondary indexes anew from the records, for a
+// store whose index is new, stale or damaged. The records get sequence
+// numbers in key order, after those already in the index, so that a
+// ChangesSince from a sequence number seen before returns every record
+// again rather than missing changes. Records that are gone, because they
+// were deleted outright while the index was stale, come up as changes too.
+// The store may be used meanwhile, but changes wait for the rebuild to
+// finish.
+func (is *InfoStore) RebuildIndex() error {
+	x := is.index
+	if x == nil {
+		return ErrorNoIndex
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	// Stale until done
+	x.stale = true
+
+	base, err := x.lastSeq()
+	if err != nil {
+		return err
+	}
+	seq := base
+	var ops []BatchOp
+	listErr := is.backend.List(Key{Number: math.MinInt64}, func(k Key, data []byte) bool {
+		seq++
+		ops = append(ops, changeOps(k, !deleted(data), seq, 0, false)...)
+		if len(ops) >= rebuildBatch {
+			err = x.apply(ops)
+			ops = nil
+		}
+		return err == nil
+	})
+	if listErr != nil {
+		return listErr
+	}
+	if err == nil {
+		err = x.apply(ops)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The records that weren't renumbered are gone
+	var gone []Key
+	err = x.backend.List(Key{[]byte{indexRecord}, nil, math.MinInt64}, func(k Key, data []byte) bool {
+		if len(k.Page) == 0 || k.Page[0] != indexRecord {
+			return false
+		}
+		if len(data) != 8 || int64(binary.BigEndian.Uint64(data)) <= base {
+			gone = append(gone, Key{k.Page[1:], k.Creator, k.Number})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	ops = nil
+	for _, k := range gone {
+		seq++
+		ops = append(ops, changeOps(k, false, seq, 0, false)...)
+		if len(ops) >= rebuildBatch {
+			if err := x.apply(ops); err != nil {
+				return err
+			}
+			ops = nil
+		}
+	}
+
+	// Everything numbered before is replaced
+	err = x.backend.List(Key{[]byte{indexSeq}, nil, math.MinInt64}, func(k Key, data []byte) bool {
+		if !bytes.Equal(k.Page, []byte{indexSeq}) || k.Number > base {
+			return false
+		}
+		ops = append(ops, BatchOp{Key: k, Delete: true})
+		return true
+	})
+	if err == nil {
+		err = x.apply(ops)
+	}
+	if err != nil {
+		return err
+	}
+	x.seq = seq
+	x.loaded = true
+	x.stale = false
+	return nil
+}
+
+// lastSeq returns the highest sequence number in the index.
+func (x *index) lastSeq() (int64, error) {
+	var last int64
+	err := x.backend.List(Key{[]byte{indexSeq}, nil, math.MinInt64}, func(k Key, data []byte) bool {
+		if !bytes.Equal(k.Page, []byte{indexSeq}) {
+			return false
+		}
+		last = k.Number
+		return true
+	})
+	return last, err
+}
+
+// IndexIterator walks the entries of a secondary index, see ByCreator and
+// ChangesSince.
+type IndexIterator struct {
+	backend Backend
+	prefix  []byte
+	from    Key
+	// entry turns an index record into a record key
+	entry func(k Key, data []byte) (Key, error)
+
+	batch []indexEntry
+	key   Key
+	seq   int64
+	err   error
+	done  bool
+}
+
+type indexEntry struct {
+	key Key
+	seq int64
+}
+
+// indexBatch is the number of entries an iterator reads at once.
+const indexBatch = 100
+
+// Next moves to the next entry, and reports whether there is one. Once it
+// returns false, Err tells whether the iterator failed.
+func (it *IndexIterator) Next() bool {
+	if len(it.batch) == 0 && !it.done && it.err == nil {
+		it.fetch()
+	}
+	if len(it.batch) == 0 {
+		return false
+	}
+	it.key = it.batch[0].key
+	it.seq = it.batch[0].seq
+	it.batch = it.batch[1:]
+	return true
+}
+
+func (it *IndexIterator) fetch() {
+	var last Key
+	var err error
+	listErr := it.backend.List(it.from, func(k Key, data []byte) bool {
+		if !bytes.Equal(k.Page, it.prefix) {
+			it.done = true
+			return false
+		}
+		var key Key
+		key, err = it.entry(k, data)
+		if err != nil {
+			return false
+		}
+		it.batch = append(it.batch, indexEntry{key, k.Number})
+		last = k
+		return len(it.batch) < indexBatch
+	})
+	if listErr != nil {
+		err = listErr
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	if len(it.batch) < indexBatch {
+		it.done = true
+		return
+	}
+	it.from = last.next()
+}
+
+// Key returns the key of the current record.
+func (it *IndexIterator) Key() Key {
+	return it.key
+}
+
+// Seq returns the sequence number of the current change, for ChangesSince.
+func (it *IndexIterator) Seq() int64 {
+	return it.seq
+}
+
+func (it *IndexIterator) Err() error {
+	return it.err
+}
+
+// ByCreator returns an iterator over the keys of the records of creator
+// that aren't deleted, in key order.
+func (is *InfoStore) ByCreator(creator []byte) *IndexIterator {
+	if is.index == nil {
+		return &IndexIterator{err: ErrorNoIndex}
+	}
+	if err := is.index.ready(); err != nil {
+		return &IndexIterator{err: err}
+	}
+	prefix := prefixed(indexCreator, creator)
+	return &IndexIterator{
+		backend: is.index.backend,
+		prefix:  prefix,
+		from:    Key{prefix, nil, math.MinInt64},
+		entry: func(k Key, data []byte) (Key, error) {
+			return Key{k.Creator, creator, k.Number}, nil
+		},
+	}
+}
+
+// ChangesSince returns an iterator over the records that were put or
+// deleted after the change with sequence number seq, in the order of their
+// last change. Start with seq 0 to get every record, and continue with the
+// Seq of the last change seen.
+func (is *InfoStore) ChangesSince(seq int64) *IndexIterator {
+	if is.index == nil {
+		return &IndexIterator{err: ErrorNoIndex}
+	}
+	if err := is.index.ready(); err != nil {
+		return &IndexIterator{err: err}
+	}
+	prefix := []byte{indexSeq}
+	return &IndexIterator{
+		backend: is.index.backend,
+		prefix:  prefix,
+		from:    Key{prefix, nil, seq + 1},
+		entry: func(k Key, data []byte) (Key, error) {
+			key, err := unmarshalKey(data)
+			if err != nil {
+				return Key{}, fmt.Errorf("change %d: %w", k.Number, err)
+			}
+			return key, nil
+		},
+	}
+}
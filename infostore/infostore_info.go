@@ -0,0 +1,28 @@
+package infostore
+
+import "encoding/json"
+
+// Info is the data of a record, signed by its creator. A record is replaced
+// by one with a higher Revision, or the same Revision and a higher Hash.
+type Info struct {
+	Page     []byte
+	Number   int64
+	Revision int64
+	Hash     []byte `json:",omitempty"`
+}
+
+func (info *Info) Marshal() []byte {
+	data, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func UnmarshalInfo(data []byte) (*Info, error) {
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,200 @@
+package infostore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math"
+	"strings"
+
+	"github.com/jakobvarmose/dc/crypto"
+)
+
+// distinct returns up to limit distinct values of field, in order, of the
+// keys from from on of records that aren't deleted. It stops at the first
+// key for which within is false, and reports whether there may be more
+// values. Once a value is taken, the listing continues at skip(value), so
+// only the records before the first live one of each value are read. A
+// limit of zero or less means no limit.
+func (is *InfoStore) distinct(ctx context.Context, from Key, within func(k Key) bool, field func(k Key) []byte, skip func(v []byte) Key, limit int) ([][]byte, bool, error) {
+	var values [][]byte
+	for {
+		var more, found bool
+		var err error
+		listErr := is.backend.List(from, func(k Key, data []byte) bool {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+			if !within(k) {
+				return false
+			}
+			if deleted(data) {
+				return true
+			}
+			if limit > 0 && len(values) == limit {
+				more = true
+				return false
+			}
+			v := field(k)
+			values = append(values, v)
+			from = skip(v)
+			found = true
+			return false
+		})
+		if listErr != nil {
+			return nil, false, listErr
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if !found {
+			return values, more, nil
+		}
+	}
+}
+
+// deleted reports whether data is a tombstone.
+func deleted(data []byte) bool {
+	signed, err := crypto.UnmarshalSigned(data)
+	return err == nil && isTombstone(signed.Data)
+}
+
+// after returns the smallest byte string after b.
+func after(b []byte) []byte {
+	return append(append([]byte(nil), b...), 0)
+}
+
+// cursorPrefix starts every cursor, so that the empty page or creator has a
+// cursor that differs from the empty one that starts a listing.
+const cursorPrefix = "p"
+
+// parseCursor returns the value a listing continues after, and whether
+// there is one.
+func parseCursor(cursor string) ([]byte, bool, error) {
+	if cursor == "" {
+		return nil, false, nil
+	}
+	if !strings.HasPrefix(cursor, cursorPrefix) {
+		return nil, false, ErrorBadCursor
+	}
+	b, err := hex.DecodeString(cursor[len(cursorPrefix):])
+	if err != nil {
+		return nil, false, ErrorBadCursor
+	}
+	return b, true, nil
+}
+
+// nextCursor returns the cursor that continues a listing after values, or
+// the empty one if there is nothing more.
+func nextCursor(values [][]byte, more bool) string {
+	if !more {
+		return ""
+	}
+	return cursorPrefix + hex.EncodeToString(values[len(values)-1])
+}
+
+// ListPages returns up to limit pages, in order, starting after cursor. The
+// empty cursor starts at the first page. The returned cursor continues the
+// listing, and is empty once all pages have been returned. A limit of zero or
+// less means no limit.
+func (is *InfoStore) ListPages(ctx context.Context, cursor string, limit int) ([][]byte, string, error) {
+	// skip returns the first key of the pages after page
+	skip := func(page []byte) Key {
+		return Key{after(page), nil, math.MinInt64}
+	}
+	from := Key{Number: math.MinInt64}
+	last, ok, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if ok {
+		from = skip(last)
+	}
+	pages, more, err := is.distinct(ctx, from, func(Key) bool { return true }, func(k Key) []byte { return k.Page }, skip, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return pages, nextCursor(pages, more), nil
+}
+
+// ListCreators returns up to limit creators with records for page, in
+// order, starting after cursor, like ListPages. Deleted records are left
+// out here and below.
+func (is *InfoStore) ListCreators(ctx context.Context, page []byte, cursor string, limit int) ([][]byte, string, error) {
+	skip := func(creator []byte) Key {
+		return Key{page, after(creator), math.MinInt64}
+	}
+	from := Key{page, nil, math.MinInt64}
+	last, ok, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if ok {
+		from = skip(last)
+	}
+	within := func(k Key) bool {
+		return bytes.Equal(k.Page, page)
+	}
+	creators, more, err := is.distinct(ctx, from, within, func(k Key) []byte { return k.Creator }, skip, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return creators, nextCursor(creators, more), nil
+}
+
+// ListNumbers returns up to limit numbers from from to to, inclusive, of the
+// records of creator for page, in order. A listing can be continued from the
+// last number plus one. A limit of zero or less means no limit.
+func (is *InfoStore) ListNumbers(page []byte, creator []byte, from int64, to int64, limit int) ([]int64, error) {
+	var numbers []int64
+	err := is.backend.List(Key{page, creator, from}, func(k Key, data []byte) bool {
+		if !bytes.Equal(k.Page, page) || !bytes.Equal(k.Creator, creator) || k.Number > to {
+			return false
+		}
+		if !deleted(data) {
+			numbers = append(numbers, k.Number)
+		}
+		return limit <= 0 || len(numbers) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return numbers, nil
+}
+
+// Latest returns the record of creator for page with the highest number, or
+// ErrorNotFound. Backends that are a ReverseLister are read from the highest
+// number down, others from the lowest up.
+func (is *InfoStore) Latest(page []byte, creator []byte) (*crypto.Signed, error) {
+	var latest []byte
+	var err error
+	if rl, ok := is.backend.(ReverseLister); ok {
+		err = rl.ListReverse(Key{page, creator, math.MaxInt64}, func(k Key, data []byte) bool {
+			if !bytes.Equal(k.Page, page) || !bytes.Equal(k.Creator, creator) {
+				return false
+			}
+			if deleted(data) {
+				return true
+			}
+			latest = data
+			return false
+		})
+	} else {
+		err = is.backend.List(Key{page, creator, math.MinInt64}, func(k Key, data []byte) bool {
+			if !bytes.Equal(k.Page, page) || !bytes.Equal(k.Creator, creator) {
+				return false
+			}
+			if !deleted(data) {
+				latest = data
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrorNotFound
+	}
+	return crypto.UnmarshalSigned(latest)
+}
@@ -0,0 +1,549 @@
+package infostore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// LogBackend keeps all records in a single file that is only appended to,
+// with an index in memory. Every change is an entry
+//
+//	length  uint32, the size of the rest of the entry
+//	crc     uint32, IEEE checksum of the rest of the entry
+//	op      byte, 'p' for put, 'd' for delete or 'b' for batch
+//	page    uint16 length followed by the bytes
+//	creator uint16 length followed by the bytes
+//	number  int64
+//	data    the rest, for puts
+//
+// with all integers in big endian. The data of a batch is a sequence of put
+// and delete entries, which are applied together. The file is rewritten without the
+// replaced and deleted records once they take up more space than the live
+// ones.
+type LogBackend struct {
+	name string
+
+	mutex sync.RWMutex
+	file  *os.File
+	size  int64
+	index map[string]logEntry
+	// keys holds the keys of the index in order
+	keys   *keyList
+	live   int64
+	closed bool
+}
+
+type logEntry struct {
+	key    Key
+	offset int64
+	size   int
+}
+
+const (
+	logPut    = 'p'
+	logDelete = 'd'
+	logBatch  = 'b'
+)
+
+// compactMin is how much space replaced and deleted records must take up
+// before the log is compacted.
+const compactMin = 1 << 20
+
+// ErrorClosed is returned by a LogBackend or DirBackend after Close.
+var ErrorClosed = errors.New("Closed")
+
+// NewLogBackend opens the log in the file name, creating it if necessary.
+// A partly written entry at the end, left by a crash, is removed.
+func NewLogBackend(name string) (*LogBackend, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b := &LogBackend{
+		name: name,
+		file: f,
+	}
+	err = b.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// load builds the index from the file and cuts off a damaged end.
+func (b *LogBackend) load() error {
+	b.index = make(map[string]logEntry)
+	b.live = 0
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := &countingReader{r: bufio.NewReader(b.file)}
+	var end int64
+	for {
+		op, k, data, err := readLogEntry(r)
+		if err == io.EOF || err == errDamaged {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case logPut:
+			b.set(logEntry{k, r.n - int64(len(data)), len(data)})
+		case logDelete:
+			b.unset(k)
+		case logBatch:
+			if !b.replayBatch(r.n-int64(len(data)), data) {
+				// A damaged batch is discarded like a damaged entry
+				err = errDamaged
+			}
+		}
+		if err == errDamaged {
+			break
+		}
+		end = r.n
+	}
+	b.size = end
+	// Sort once, rather than keeping the keys in order while replaying
+	keys := make([]Key, 0, len(b.index))
+	for _, e := range b.index {
+		keys = append(keys, e.key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+	b.keys = newKeyList(keys)
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != end {
+		return b.file.Truncate(end)
+	}
+	return nil
+}
+
+var errDamaged = errors.New("damaged entry")
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func readLogEntry(r io.Reader) (byte, Key, []byte, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return 0, Key{}, nil, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return 0, Key{}, nil, errDamaged
+	}
+	if err != nil {
+		return 0, Key{}, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1+2+2+8 || n > 1<<30 {
+		return 0, Key{}, nil, errDamaged
+	}
+	rest := make([]byte, n)
+	_, err = io.ReadFull(r, rest)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, Key{}, nil, errDamaged
+	}
+	if err != nil {
+		return 0, Key{}, nil, err
+	}
+	if crc32.ChecksumIEEE(rest) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, Key{}, nil, errDamaged
+	}
+	op := rest[0]
+	rest = rest[1:]
+	var k Key
+	var ok bool
+	if k.Page, rest, ok = readField(rest); !ok {
+		return 0, Key{}, nil, errDamaged
+	}
+	if k.Creator, rest, ok = readField(rest); !ok {
+		return 0, Key{}, nil, errDamaged
+	}
+	if len(rest) < 8 {
+		return 0, Key{}, nil, errDamaged
+	}
+	k.Number = int64(binary.BigEndian.Uint64(rest))
+	return op, k, rest[8:], nil
+}
+
+func readField(buf []byte) ([]byte, []byte, bool) {
+	if len(buf) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return nil, nil, false
+	}
+	return append([]byte{}, buf[2:2+n]...), buf[2+n:], true
+}
+
+func appendLogEntry(buf []byte, op byte, k Key, data []byte) ([]byte, error) {
+	if len(k.Page) > 0xffff || len(k.Creator) > 0xffff {
+		return nil, errors.New("key too long")
+	}
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0, op)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(k.Page)))
+	buf = append(buf, k.Page...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(k.Creator)))
+	buf = append(buf, k.Creator...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(k.Number))
+	buf = append(buf, data...)
+	rest := buf[start+8:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(rest)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(rest))
+	return buf, nil
+}
+
+// set and unset update the index, but not the order of the keys. They
+// report whether the key is new or was there.
+func (b *LogBackend) set(e logEntry) bool {
+	mk := memoryKey(e.key)
+	old, ok := b.index[mk]
+	if ok {
+		b.live -= int64(old.size)
+	}
+	b.index[mk] = e
+	b.live += int64(e.size)
+	return !ok
+}
+
+func (b *LogBackend) unset(k Key) bool {
+	mk := memoryKey(k)
+	old, ok := b.index[mk]
+	if !ok {
+		return false
+	}
+	b.live -= int64(old.size)
+	delete(b.index, mk)
+	return true
+}
+
+// replayBatch applies the entries of a batch whose data starts at offset,
+// unless one of them is damaged.
+func (b *LogBackend) replayBatch(offset int64, data []byte) bool {
+	type change struct {
+		op    byte
+		entry logEntry
+	}
+	var changes []change
+	r := &countingReader{r: bytes.NewReader(data)}
+	for {
+		op, k, sub, err := readLogEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || (op != logPut && op != logDelete) {
+			return false
+		}
+		changes = append(changes, change{op, logEntry{k, offset + r.n - int64(len(sub)), len(sub)}})
+	}
+	for _, c := range changes {
+		if c.op == logPut {
+			b.set(c.entry)
+		} else {
+			b.unset(c.entry.key)
+		}
+	}
+	return true
+}
+
+// write appends an entry and syncs the file.
+func (b *LogBackend) write(op byte, k Key, data []byte) (int64, error) {
+	buf, err := appendLogEntry(nil, op, k, data)
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.file.WriteAt(buf, b.size)
+	if err == nil {
+		err = b.file.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial entry behind the next one
+		b.file.Truncate(b.size)
+		return 0, err
+	}
+	b.size += int64(len(buf))
+	return b.size - int64(len(data)), nil
+}
+
+func (b *LogBackend) Get(k Key) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return nil, ErrorClosed
+	}
+	e, ok := b.index[memoryKey(k)]
+	if !ok {
+		return nil, ErrorNotFound
+	}
+	data := make([]byte, e.size)
+	_, err := b.file.ReadAt(data, e.offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *LogBackend) Put(k Key, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrorClosed
+	}
+	offset, err := b.write(logPut, k, data)
+	if err != nil {
+		return err
+	}
+	if b.set(logEntry{k, offset, len(data)}) {
+		b.keys.insert(k)
+	}
+	b.maybeCompact()
+	return nil
+}
+
+func (b *LogBackend) Delete(k Key) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrorClosed
+	}
+	if _, ok := b.index[memoryKey(k)]; !ok {
+		return ErrorNotFound
+	}
+	_, err := b.write(logDelete, k, nil)
+	if err != nil {
+		return err
+	}
+	if b.unset(k) {
+		b.keys.remove(k)
+	}
+	b.maybeCompact()
+	return nil
+}
+
+// Batch writes the changes as a single entry, with a single sync.
+func (b *LogBackend) Batch(ops []BatchOp) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrorClosed
+	}
+	var payload []byte
+	// offsets holds the offset of the data of every op in the payload
+	offsets := make([]int, len(ops))
+	for i, op := range ops {
+		var err error
+		if op.Delete {
+			payload, err = appendLogEntry(payload, logDelete, op.Key, nil)
+		} else {
+			payload, err = appendLogEntry(payload, logPut, op.Key, op.Data)
+		}
+		if err != nil {
+			return err
+		}
+		offsets[i] = len(payload) - len(op.Data)
+	}
+	offset, err := b.write(logBatch, Key{}, payload)
+	if err != nil {
+		return err
+	}
+	for i, op := range ops {
+		if op.Delete {
+			if b.unset(op.Key) {
+				b.keys.remove(op.Key)
+			}
+		} else if b.set(logEntry{op.Key, offset + int64(offsets[i]), len(op.Data)}) {
+			b.keys.insert(op.Key)
+		}
+	}
+	b.maybeCompact()
+	return nil
+}
+
+// listBatch is the number of records List reads while holding the lock.
+const listBatch = 100
+
+// List reads the records in batches and calls fn without holding the lock,
+// so fn may modify the backend.
+func (b *LogBackend) List(from Key, fn func(k Key, data []byte) bool) error {
+	for {
+		keys, records, err := b.batch(from)
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if !fn(k, records[i]) {
+				return nil
+			}
+		}
+		if len(keys) < listBatch {
+			return nil
+		}
+		from = keys[len(keys)-1].next()
+	}
+}
+
+func (b *LogBackend) batch(from Key) ([]Key, [][]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return nil, nil, ErrorClosed
+	}
+	var keys []Key
+	for n := b.keys.seek(from); n != nil && len(keys) < listBatch; n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	records, err := b.read(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, records, nil
+}
+
+// ListReverse reads the records in batches, like List. Every step back
+// is a seek, which takes logarithmic time.
+func (b *LogBackend) ListReverse(to Key, fn func(k Key, data []byte) bool) error {
+	before := to.next()
+	for {
+		keys, records, err := b.batchReverse(before)
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if !fn(k, records[i]) {
+				return nil
+			}
+		}
+		if len(keys) < listBatch {
+			return nil
+		}
+		before = keys[len(keys)-1]
+	}
+}
+
+func (b *LogBackend) batchReverse(before Key) ([]Key, [][]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return nil, nil, ErrorClosed
+	}
+	var keys []Key
+	for n := b.keys.before(before); n != nil && len(keys) < listBatch; n = b.keys.before(n.key) {
+		keys = append(keys, n.key)
+	}
+	records, err := b.read(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, records, nil
+}
+
+// read returns the records with the given keys. The lock must be held.
+func (b *LogBackend) read(keys []Key) ([][]byte, error) {
+	records := make([][]byte, len(keys))
+	for j, k := range keys {
+		e := b.index[memoryKey(k)]
+		records[j] = make([]byte, e.size)
+		_, err := b.file.ReadAt(records[j], e.offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// maybeCompact rewrites the file with only the live records if the others
+// take up more space. It runs after a change has been written, so failures
+// are only reported; the file is compacted on a later change.
+func (b *LogBackend) maybeCompact() {
+	dead := b.size - b.live
+	if dead < compactMin || dead < b.live {
+		return
+	}
+	err := b.compact()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compacting %s: %v\n", b.name, err)
+	}
+}
+
+func (b *LogBackend) compact() error {
+	tmp := b.name + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for n := b.keys.seek(Key{Number: math.MinInt64}); n != nil; n = n.next[0] {
+		k := n.key
+		e := b.index[memoryKey(k)]
+		data := make([]byte, e.size)
+		_, err = b.file.ReadAt(data, e.offset)
+		if err != nil {
+			break
+		}
+		buf, err = appendLogEntry(buf[:0], logPut, k, data)
+		if err != nil {
+			break
+		}
+		_, err = f.Write(buf)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, b.name)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// The old file is unlinked, so writes must go to the new one even if
+	// the rename isn't durable yet
+	b.file.Close()
+	b.file = f
+	err = b.load()
+	if err != nil {
+		return err
+	}
+	return syncDir(path.Dir(b.name))
+}
+
+func (b *LogBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrorClosed
+	}
+	b.closed = true
+	return b.file.Close()
+}
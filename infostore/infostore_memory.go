@@ -0,0 +1,114 @@
+package infostore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryBackend keeps the records in memory. It is meant for tests.
+type MemoryBackend struct {
+	mutex   sync.Mutex
+	records map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	key  Key
+	data []byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		records: make(map[string]memoryRecord),
+	}
+}
+
+func memoryKey(k Key) string {
+	return fmt.Sprintf("%x/%x/%d", k.Page, k.Creator, k.Number)
+}
+
+func (b *MemoryBackend) Get(k Key) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	rec, ok := b.records[memoryKey(k)]
+	if !ok {
+		return nil, ErrorNotFound
+	}
+	return append([]byte(nil), rec.data...), nil
+}
+
+func (b *MemoryBackend) Put(k Key, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.records[memoryKey(k)] = memoryRecord{k, append([]byte(nil), data...)}
+	return nil
+}
+
+func (b *MemoryBackend) Delete(k Key) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.records[memoryKey(k)]; !ok {
+		return ErrorNotFound
+	}
+	delete(b.records, memoryKey(k))
+	return nil
+}
+
+func (b *MemoryBackend) Batch(ops []BatchOp) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			delete(b.records, memoryKey(op.Key))
+		} else {
+			b.records[memoryKey(op.Key)] = memoryRecord{op.Key, append([]byte(nil), op.Data...)}
+		}
+	}
+	return nil
+}
+
+// List works on a copy of the records, so fn may modify the backend.
+func (b *MemoryBackend) List(from Key, fn func(k Key, data []byte) bool) error {
+	b.mutex.Lock()
+	var records []memoryRecord
+	for _, rec := range b.records {
+		if compareKeys(rec.key, from) >= 0 {
+			records = append(records, rec)
+		}
+	}
+	b.mutex.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return compareKeys(records[i].key, records[j].key) < 0
+	})
+	for _, rec := range records {
+		if !fn(rec.key, append([]byte(nil), rec.data...)) {
+			break
+		}
+	}
+	return nil
+}
+
+// ListReverse works on a copy of the records, like List.
+func (b *MemoryBackend) ListReverse(to Key, fn func(k Key, data []byte) bool) error {
+	b.mutex.Lock()
+	var records []memoryRecord
+	for _, rec := range b.records {
+		if compareKeys(rec.key, to) <= 0 {
+			records = append(records, rec)
+		}
+	}
+	b.mutex.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return compareKeys(records[i].key, records[j].key) > 0
+	})
+	for _, rec := range records {
+		if !fn(rec.key, append([]byte(nil), rec.data...)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,113 @@
+package infostore
+
+// keyList is a skip list that keeps keys in order, with insertions,
+// removals and seeks in logarithmic time.
+type keyList struct {
+	head  skipNode
+	level int
+	// seed drives the choice of levels
+	seed uint64
+}
+
+type skipNode struct {
+	key  Key
+	next []*skipNode
+}
+
+// skipMaxLevel is enough for 2^32 keys, as every level holds about half of
+// the keys of the one below.
+const skipMaxLevel = 32
+
+// newKeyList returns a list holding keys, which must be sorted and unique.
+// It takes linear time.
+func newKeyList(keys []Key) *keyList {
+	l := &keyList{
+		head:  skipNode{next: make([]*skipNode, skipMaxLevel)},
+		level: 1,
+		seed:  0x9e3779b97f4a7c15,
+	}
+	var tails [skipMaxLevel]*skipNode
+	for i := range tails {
+		tails[i] = &l.head
+	}
+	for _, k := range keys {
+		n := l.newNode(k)
+		for i := range n.next {
+			tails[i].next[i] = n
+			tails[i] = n
+		}
+	}
+	return l
+}
+
+// newNode returns a node for k with a random level, raising the level of
+// the list if needed.
+func (l *keyList) newNode(k Key) *skipNode {
+	// xorshift64
+	l.seed ^= l.seed << 13
+	l.seed ^= l.seed >> 7
+	l.seed ^= l.seed << 17
+	level := 1
+	for r := l.seed; r&1 == 1 && level < skipMaxLevel; r >>= 1 {
+		level++
+	}
+	if level > l.level {
+		l.level = level
+	}
+	return &skipNode{key: k, next: make([]*skipNode, level)}
+}
+
+// find fills prev with the last node before k on every level.
+func (l *keyList) find(k Key, prev *[skipMaxLevel]*skipNode) {
+	n := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && compareKeys(n.next[i].key, k) < 0 {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+}
+
+// insert adds k, which must not be in the list yet.
+func (l *keyList) insert(k Key) {
+	var prev [skipMaxLevel]*skipNode
+	for i := range prev {
+		prev[i] = &l.head
+	}
+	l.find(k, &prev)
+	n := l.newNode(k)
+	for i := range n.next {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+}
+
+// remove removes k, if it is in the list.
+func (l *keyList) remove(k Key) {
+	var prev [skipMaxLevel]*skipNode
+	l.find(k, &prev)
+	n := prev[0].next[0]
+	if n == nil || compareKeys(n.key, k) != 0 {
+		return
+	}
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+}
+
+// seek returns the node of the first key from k on, or nil.
+func (l *keyList) seek(k Key) *skipNode {
+	var prev [skipMaxLevel]*skipNode
+	l.find(k, &prev)
+	return prev[0].next[0]
+}
+
+// before returns the node of the last key before k, or nil.
+func (l *keyList) before(k Key) *skipNode {
+	var prev [skipMaxLevel]*skipNode
+	l.find(k, &prev)
+	if prev[0] == &l.head {
+		return nil
+	}
+	return prev[0]
+}
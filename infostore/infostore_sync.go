@@ -0,0 +1,359 @@
+package infostore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jakobvarmose/dc/crypto"
+)
+
+// Two stores are synced by reconciling ranges of keys. The peers take turns
+// sending a syncMessage. For every range in a message, the receiver
+// compares the fingerprint of the sender's records in the range with its
+// own. Ranges that differ are split in two and sent back, until they hold
+// few enough records to send a list of their versions instead. A version
+// list is answered with the records the sender lacks or has older versions
+// of, and with the keys of the records the receiver wants in turn.
+//
+// A range is read syncScanMax records at a time. Ranges with more records
+// than that are described in parts, with a fingerprint each, so the peer
+// compares them part by part. A message holds at most syncMessageMax
+// ranges, versions, records and keys; what doesn't fit waits for the next
+// message, which More announces. A peer that receives a message that asks
+// for nothing, having no ranges, wants or More, only stores the records in
+// it, and the sync is done once neither peer has anything left to send.
+
+// syncListMax is the number of records up to which a range is sent as a
+// list of versions rather than split.
+const syncListMax = 16
+
+// syncScanMax is the number of records read from a range at once.
+const syncScanMax = 1024
+
+// syncMessageMax is the number of ranges, versions, records and wanted keys
+// sent in one message.
+const syncMessageMax = 256
+
+type syncMessage struct {
+	Ranges  []syncRange `json:",omitempty"`
+	Records [][]byte    `json:",omitempty"`
+	Want    []Key       `json:",omitempty"`
+	// More is set if the sender has more to send, so the receiver must
+	// answer even if the message asks for nothing else
+	More bool `json:",omitempty"`
+}
+
+// asks reports whether the receiver of m must answer it.
+func (m *syncMessage) asks() bool {
+	return len(m.Ranges) > 0 || len(m.Want) > 0 || m.More
+}
+
+// syncRange covers the keys from From up to but not including To, or all
+// keys from From on if To is nil. It holds either the fingerprint and
+// count of the sender's records, or their versions if List is set.
+type syncRange struct {
+	From        Key
+	To          *Key          `json:",omitempty"`
+	Fingerprint []byte        `json:",omitempty"`
+	Count       int           `json:",omitempty"`
+	List        bool          `json:",omitempty"`
+	Versions    []syncVersion `json:",omitempty"`
+}
+
+type syncVersion struct {
+	Key Key
+	version
+}
+
+// Sync starts a sync with the store at the other end of rw, which must call
+// ServeSync. Afterwards both stores hold the newest version of every record
+// either of them had, as decided by the same rule as Put, so tombstones are
+// synced too. Records received are verified like in Put, and those that
+// Put rejects are skipped. Sync returns the number of skipped records.
+func (is *InfoStore) Sync(rw io.ReadWriter) (int, error) {
+	s := is.newSync(rw)
+	s.describe = []syncRange{{From: Key{Number: math.MinInt64}}}
+	msg, err := s.next()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.enc.Encode(msg); err != nil {
+		return 0, err
+	}
+	err = s.run()
+	return s.skipped, err
+}
+
+// ServeSync answers a sync started by the store at the other end of rw,
+// see Sync.
+func (is *InfoStore) ServeSync(rw io.ReadWriter) (int, error) {
+	s := is.newSync(rw)
+	err := s.run()
+	return s.skipped, err
+}
+
+type syncer struct {
+	is  *InfoStore
+	enc *json.Encoder
+	dec *json.Decoder
+	// skipped counts the records received that Put rejected
+	skipped int
+
+	// What is left to send: ranges of our own records that are yet to be
+	// read and described, ranges, wanted keys and the keys of records
+	ranges   []syncRange
+	describe []syncRange
+	want     []Key
+	send     []Key
+}
+
+func (is *InfoStore) newSync(rw io.ReadWriter) *syncer {
+	return &syncer{
+		is:  is,
+		enc: json.NewEncoder(rw),
+		dec: json.NewDecoder(rw),
+	}
+}
+
+func (s *syncer) run() error {
+	for {
+		var msg syncMessage
+		if err := s.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		for _, data := range msg.Records {
+			signed, err := crypto.UnmarshalSigned(data)
+			if err != nil {
+				s.skipped++
+				continue
+			}
+			err = s.is.Put(signed)
+			if errors.Is(err, ErrBadSignature) || errors.Is(err, ErrMalformedInfo) {
+				s.skipped++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+		}
+		if !msg.asks() && !s.pending() {
+			return nil
+		}
+		if err := s.answer(&msg); err != nil {
+			return err
+		}
+		reply, err := s.next()
+		if err != nil {
+			return err
+		}
+		if err := s.enc.Encode(reply); err != nil {
+			return err
+		}
+		// The peer only waits for more if it has more to send itself
+		if !reply.asks() && !msg.More {
+			return nil
+		}
+	}
+}
+
+// pending reports whether anything is left to send.
+func (s *syncer) pending() bool {
+	return len(s.ranges) > 0 || len(s.describe) > 0 || len(s.want) > 0 || len(s.send) > 0
+}
+
+// answer adds what msg asks for to what is left to send.
+func (s *syncer) answer(msg *syncMessage) error {
+	s.send = append(s.send, msg.Want...)
+	for _, r := range msg.Ranges {
+		versions, next, err := s.is.syncScan(r.From, r.To)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			// Too many to compare at once, so the peer gets to compare
+			// our records part by part
+			s.describe = append(s.describe, syncRange{From: r.From, To: r.To})
+			continue
+		}
+		if r.List {
+			s.compare(r.Versions, versions)
+			continue
+		}
+		if r.Count == len(versions) && bytes.Equal(r.Fingerprint, fingerprint(versions)) {
+			continue
+		}
+		if len(versions) <= syncListMax {
+			s.ranges = append(s.ranges, syncRange{
+				From:     r.From,
+				To:       r.To,
+				List:     true,
+				Versions: versions,
+			})
+			continue
+		}
+		mid := versions[len(versions)/2].Key
+		s.ranges = append(s.ranges,
+			syncRange{
+				From:        r.From,
+				To:          &mid,
+				Fingerprint: fingerprint(versions[:len(versions)/2]),
+				Count:       len(versions) / 2,
+			},
+			syncRange{
+				From:        mid,
+				To:          r.To,
+				Fingerprint: fingerprint(versions[len(versions)/2:]),
+				Count:       len(versions) - len(versions)/2,
+			},
+		)
+	}
+	return nil
+}
+
+// next returns the next message, with as much of what is left to send as
+// fits.
+func (s *syncer) next() (*syncMessage, error) {
+	msg := &syncMessage{}
+	room := syncMessageMax
+	for room > 0 {
+		if len(s.ranges) == 0 {
+			if len(s.describe) == 0 {
+				break
+			}
+			// Describe the next part of a range
+			r := &s.describe[0]
+			versions, next, err := s.is.syncScan(r.From, r.To)
+			if err != nil {
+				return nil, err
+			}
+			part := syncRange{
+				From:        r.From,
+				To:          r.To,
+				Fingerprint: fingerprint(versions),
+				Count:       len(versions),
+			}
+			if next != nil {
+				part.To = next
+				r.From = *next
+			} else {
+				s.describe = s.describe[1:]
+			}
+			s.ranges = append(s.ranges, part)
+		}
+		size := 1 + len(s.ranges[0].Versions)
+		if size > room && len(msg.Ranges) > 0 {
+			break
+		}
+		msg.Ranges = append(msg.Ranges, s.ranges[0])
+		s.ranges = s.ranges[1:]
+		room -= size
+	}
+	n := len(s.want)
+	if n > room {
+		n = room
+	}
+	msg.Want = s.want[:n:n]
+	s.want = s.want[n:]
+	room -= n
+	for room > 0 && len(s.send) > 0 {
+		k := s.send[0]
+		s.send = s.send[1:]
+		data, err := s.is.backend.Get(k)
+		if err == ErrorNotFound {
+			// Deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg.Records = append(msg.Records, data)
+		room--
+	}
+	msg.More = s.pending()
+	return msg, nil
+}
+
+// compare adds the keys of the records that the peer lacks or has older
+// versions of to those to send, and the keys of those that it has newer
+// versions of to the wants.
+func (s *syncer) compare(theirs []syncVersion, ours []syncVersion) {
+	peer := make(map[string]syncVersion, len(theirs))
+	for _, v := range theirs {
+		peer[memoryKey(v.Key)] = v
+	}
+	for _, v := range ours {
+		key := memoryKey(v.Key)
+		p, ok := peer[key]
+		delete(peer, key)
+		if !ok || v.newer(p.version) {
+			s.send = append(s.send, v.Key)
+		} else if p.newer(v.version) {
+			s.want = append(s.want, v.Key)
+		}
+	}
+	for _, v := range theirs {
+		if _, ok := peer[memoryKey(v.Key)]; ok {
+			s.want = append(s.want, v.Key)
+		}
+	}
+}
+
+// syncScan returns the versions of up to syncScanMax records from from up
+// to to, and the key of the next record in the range if there are more.
+// The records themselves are read again if they are sent, so that they
+// aren't all held at once.
+func (is *InfoStore) syncScan(from Key, to *Key) ([]syncVersion, *Key, error) {
+	var versions []syncVersion
+	var next *Key
+	var err error
+	listErr := is.backend.List(from, func(k Key, data []byte) bool {
+		if to != nil && compareKeys(k, *to) >= 0 {
+			return false
+		}
+		if len(versions) == syncScanMax {
+			next = &k
+			return false
+		}
+		var rec *record
+		rec, err = unmarshalRecord(data)
+		if err != nil {
+			err = fmt.Errorf("%x/%x/%d: %w", k.Page, k.Creator, k.Number, err)
+			return false
+		}
+		versions = append(versions, syncVersion{k, rec.version()})
+		return true
+	})
+	if listErr != nil {
+		return nil, nil, listErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return versions, next, nil
+}
+
+// fingerprint combines the hashes of the versions with xor, so that it
+// doesn't depend on how a range is split.
+func fingerprint(versions []syncVersion) []byte {
+	fp := make([]byte, sha256.Size)
+	for _, v := range versions {
+		h := sha256.New()
+		for _, b := range [][]byte{v.Key.Page, v.Key.Creator, v.Hash} {
+			binary.Write(h, binary.BigEndian, uint32(len(b)))
+			h.Write(b)
+		}
+		binary.Write(h, binary.BigEndian, v.Key.Number)
+		binary.Write(h, binary.BigEndian, v.Revision)
+		binary.Write(h, binary.BigEndian, v.Deleted)
+		for i, b := range h.Sum(nil) {
+			fp[i] ^= b
+		}
+	}
+	return fp
+}
@@ -0,0 +1,1300 @@
+package infostore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jakobvarmose/dc/crypto"
+)
+
+func put(t *testing.T, is *InfoStore, creator []byte, info *Info) {
+	t.Helper()
+	err := is.Put(&crypto.Signed{
+		Pubkey: creator,
+		Data:   info.Marshal(),
+	}, Trusted())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubject(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	is, err := NewInfoStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := []byte("page")
+	creator := []byte("creator")
+	put(t, is, creator, &Info{Page: page, Number: 1, Revision: 1})
+	put(t, is, creator, &Info{Page: page, Number: 2, Revision: 1})
+	put(t, is, creator, &Info{Page: []byte("other"), Number: 1, Revision: 1})
+
+	r := is.Subject(page)
+	defer r.Close()
+	received := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		info := r.Next(ctx)
+		if info == nil {
+			t.Fatal(r.Err())
+		}
+		received[info.Number] = true
+	}
+	if !received[1] || !received[2] {
+		t.Errorf("received %v", received)
+	}
+
+	put(t, is, creator, &Info{Page: page, Number: 1, Revision: 2})
+	put(t, is, creator, &Info{Page: page, Number: 3, Revision: 1})
+	for _, number := range []int64{1, 3} {
+		info := r.Next(ctx)
+		if info == nil {
+			t.Fatal(r.Err())
+		}
+		if info.Number != number {
+			t.Errorf("received %d, expected %d", info.Number, number)
+		}
+	}
+	short, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+	if info := r.Next(short); info != nil {
+		t.Errorf("received %d again", info.Number)
+	}
+
+	r.Close()
+	if _, ok := <-r.Ch; ok {
+		t.Error("channel not closed")
+	}
+	if r.Err() != nil {
+		t.Error(r.Err())
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	is, err := NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := []byte("page")
+	creator := []byte("creator")
+	put(t, is, creator, &Info{Page: page, Number: 1, Revision: 1})
+	put(t, is, creator, &Info{Page: page, Number: 2, Revision: 1})
+
+	// A torn write and an unfinished one, then a crash, which leaves the
+	// journal as it is
+	recordDir := path.Join(dir, fmt.Sprintf("%x", page), fmt.Sprintf("%x", creator))
+	good, err := ioutil.ReadFile(path.Join(recordDir, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(recordDir, "2"), good[:len(good)/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(recordDir, tempPrefix+"123"), good, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := func(is *InfoStore) {
+		is.backend.(*DirBackend).journal.Close()
+		is.index.backend.Close()
+	}
+	crash(is)
+
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.Get(page, creator, 1); err != nil {
+		t.Errorf("intact record: %v", err)
+	}
+	if _, err := is.Get(page, creator, 2); err == nil {
+		t.Error("torn record still there")
+	}
+	name := path.Join(fmt.Sprintf("%x", page), fmt.Sprintf("%x", creator), "2")
+	if _, err := os.Stat(path.Join(dir, quarantineDir, name)); err != nil {
+		t.Errorf("torn record not quarantined: %v", err)
+	}
+	if _, err := os.Stat(path.Join(recordDir, tempPrefix+"123")); !os.IsNotExist(err) {
+		t.Error("temporary file not removed")
+	}
+
+	// Directories left empty by Delete
+	if err := is.Delete(page, creator, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := is.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, fmt.Sprintf("%x", page))); !os.IsNotExist(err) {
+		t.Error("empty page directory not removed")
+	}
+
+	// Records outside the journal are only checked without a journal
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(recordDir, "3"), good[:len(good)/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := is.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(recordDir, "3")); err != nil {
+		t.Errorf("record outside the journal checked: %v", err)
+	}
+	if err := os.Remove(path.Join(dir, journalFile)); err != nil {
+		t.Fatal(err)
+	}
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	if _, err := os.Stat(path.Join(dir, quarantineDir, path.Dir(name), "3")); err != nil {
+		t.Errorf("torn record not quarantined without a journal: %v", err)
+	}
+}
+
+func TestDirPutDelete(t *testing.T) {
+	b, err := NewDirBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Puts and Deletes of records that share directories
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := Key{[]byte("page"), []byte("creator"), int64(i)}
+			for j := 0; j < 100; j++ {
+				if err := b.Put(k, []byte("data")); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := b.Delete(k); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentPut(t *testing.T) {
+	is, err := NewInfoStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := []byte("page")
+	creator := []byte("creator")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				// Many Puts share each revision, with different hashes
+				info := &Info{
+					Page:     page,
+					Number:   1,
+					Revision: int64((i + j) % 20),
+					Hash:     []byte{byte(i)},
+				}
+				err := is.Put(&crypto.Signed{
+					Pubkey: creator,
+					Data:   info.Marshal(),
+				}, Trusted())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	signed, err := is.Get(page, creator, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := UnmarshalInfo(signed.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revision 19 is put by goroutines 10 to 19 and 30 to 39, of which 39
+	// has the highest hash
+	if info.Revision != 19 || info.Hash[0] != 39 {
+		t.Errorf("revision %d, hash %d won", info.Revision, info.Hash[0])
+	}
+}
+
+func TestBackends(t *testing.T) {
+	t.Run("dir", func(t *testing.T) {
+		b, err := NewDirBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBackend(t, b)
+	})
+	t.Run("log", func(t *testing.T) {
+		b, err := NewLogBackend(path.Join(t.TempDir(), "log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBackend(t, b)
+	})
+	t.Run("memory", func(t *testing.T) {
+		testBackend(t, NewMemoryBackend())
+	})
+}
+
+func listKeys(t *testing.T, b Backend, from Key) []Key {
+	t.Helper()
+	var keys []Key
+	err := b.List(from, func(k Key, data []byte) bool {
+		if string(data) != fmt.Sprintf("%s/%s/%d", k.Page, k.Creator, k.Number) {
+			t.Errorf("%v: data %q", k, data)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testBackend(t *testing.T, b Backend) {
+	defer b.Close()
+	keys := []Key{
+		{[]byte{}, []byte("a"), 1},
+		{[]byte("p"), []byte("a"), -1},
+		{[]byte("p"), []byte("a"), 2},
+		{[]byte("p"), []byte("a"), 10},
+		{[]byte("p"), []byte("b"), 1},
+		{[]byte("q"), []byte("a"), 1},
+	}
+	// Out of order, and one twice
+	for _, i := range []int{3, 0, 5, 1, 4, 2, 3} {
+		k := keys[i]
+		err := b.Put(k, []byte(fmt.Sprintf("%s/%s/%d", k.Page, k.Creator, k.Number)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Get(Key{[]byte("p"), []byte("a"), 3}); err != ErrorNotFound {
+		t.Errorf("get missing: %v", err)
+	}
+	data, err := b.Get(keys[2])
+	if err != nil || string(data) != "p/a/2" {
+		t.Errorf("get: %q, %v", data, err)
+	}
+
+	if got := listKeys(t, b, Key{}); fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Errorf("listed %v", got)
+	}
+	if got := listKeys(t, b, keys[2].next()); fmt.Sprint(got) != fmt.Sprint(keys[3:]) {
+		t.Errorf("listed from %v: %v", keys[2].next(), got)
+	}
+
+	if err := b.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(keys[1]); err != ErrorNotFound {
+		t.Errorf("delete twice: %v", err)
+	}
+	expected := append(keys[:1:1], keys[2:]...)
+	if got := listKeys(t, b, Key{}); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("listed %v after delete", got)
+	}
+
+	var reversed []Key
+	err = b.(ReverseLister).ListReverse(keys[4], func(k Key, data []byte) bool {
+		reversed = append(reversed, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(reversed) != fmt.Sprint([]Key{keys[4], keys[3], keys[2], keys[0]}) {
+		t.Errorf("listed %v backwards", reversed)
+	}
+}
+
+func TestLogBackend(t *testing.T) {
+	name := path.Join(t.TempDir(), "log")
+	b, err := NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{[]byte("p"), []byte("c"), 1}
+	// Enough replacements to compact
+	data := make([]byte, 1000)
+	for i := 0; i < 2000; i++ {
+		data[0] = byte(i)
+		if err := b.Put(k, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Put(Key{[]byte("p"), []byte("c"), 2}, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(Key{[]byte("p"), []byte("c"), 2}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > compactMin+2*int64(len(data)) {
+		t.Errorf("log not compacted, %d bytes", info.Size())
+	}
+
+	// A torn entry at the end
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	b, err = NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	got, err := b.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != byte(1999%256) {
+		t.Errorf("got version %d after reopen", got[0])
+	}
+	if _, err := b.Get(Key{[]byte("p"), []byte("c"), 2}); err != ErrorNotFound {
+		t.Errorf("deleted record after reopen: %v", err)
+	}
+	if err := b.Put(Key{[]byte("p"), []byte("c"), 3}, data); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = b.List(Key{}, func(Key, []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 2 {
+		t.Errorf("listed %d records: %v", count, err)
+	}
+}
+
+func TestLogBackendCompactFailure(t *testing.T) {
+	name := path.Join(t.TempDir(), "log")
+	b, err := NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// The compacted file can't be created
+	if err := os.Mkdir(name+".compact", 0755); err != nil {
+		t.Fatal(err)
+	}
+	k := Key{[]byte("p"), []byte("c"), 1}
+	data := make([]byte, 1000)
+	for i := 0; i < 2000; i++ {
+		data[0] = byte(i)
+		if err := b.Put(k, data); err != nil {
+			t.Fatalf("put failed after being written: %v", err)
+		}
+	}
+	got, err := b.Get(k)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes: %v", len(got), err)
+	}
+}
+
+func TestLogBackendBatch(t *testing.T) {
+	name := path.Join(t.TempDir(), "log")
+	b, err := NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1 := Key{[]byte("p"), []byte("c"), 1}
+	k2 := Key{[]byte("p"), []byte("c"), 2}
+	if err := b.Put(k1, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	err = b.Batch([]BatchOp{
+		{Key: k1, Delete: true},
+		{Key: k2, Data: []byte("two")},
+		{Key: Key{[]byte("p"), []byte("c"), 3}, Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b, err = NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Get(k1); err != ErrorNotFound {
+		t.Errorf("deleted record after reopen: %v", err)
+	}
+	if got, err := b.Get(k2); err != nil || string(got) != "two" {
+		t.Errorf("got %q after reopen: %v", got, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{Backend: NewMemoryBackend()}
+	is := NewInfoStoreWithBackend(backend)
+	for _, page := range []string{"", "b", "a", "c"} {
+		for _, creator := range []string{"y", "x"} {
+			for _, number := range []int64{3, -1, 2} {
+				put(t, is, []byte(creator), &Info{Page: []byte(page), Number: number, Revision: 1})
+			}
+		}
+	}
+
+	// The first record of every page is deleted, and the last of a/y
+	deletions := []Key{{[]byte("a"), []byte("y"), 3}}
+	for _, page := range []string{"", "b", "a", "c"} {
+		deletions = append(deletions, Key{[]byte(page), []byte("x"), -1})
+	}
+	for _, k := range deletions {
+		tombstone := &Tombstone{Page: k.Page, Number: k.Number, Revision: 2, Time: time.Now()}
+		err := is.Put(&crypto.Signed{Pubkey: k.Creator, Data: tombstone.Marshal()}, Trusted())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pages []string
+	cursor := ""
+	calls := int64(0)
+	atomic.StoreInt64(&backend.records, 0)
+	for {
+		calls++
+		list, next, err := is.ListPages(ctx, cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, page := range list {
+			pages = append(pages, string(page))
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprintf("%q", pages) != `["" "a" "b" "c"]` {
+		t.Errorf("pages %q", pages)
+	}
+	// Only the records up to the first live one of every page are read, and
+	// those that show there are more
+	if records := atomic.LoadInt64(&backend.records); records > 2*(int64(len(pages))+calls) {
+		t.Errorf("%d records read for %d pages in %d calls", records, len(pages), calls)
+	}
+	if _, _, err := is.ListPages(ctx, "bad", 1); err != ErrorBadCursor {
+		t.Errorf("bad cursor: %v", err)
+	}
+
+	creators, next, err := is.ListCreators(ctx, []byte("b"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%s", creators) != "[x]" || next == "" {
+		t.Errorf("creators %s, cursor %q", creators, next)
+	}
+	creators, next, err = is.ListCreators(ctx, []byte("b"), next, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%s", creators) != "[y]" || next != "" {
+		t.Errorf("creators %s, cursor %q", creators, next)
+	}
+	if _, _, err := is.ListCreators(ctx, []byte("b"), "bad", 1); err != ErrorBadCursor {
+		t.Errorf("bad cursor: %v", err)
+	}
+
+	numbers, err := is.ListNumbers([]byte("b"), []byte("x"), 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(numbers) != "[2]" {
+		t.Errorf("numbers %v", numbers)
+	}
+	numbers, err = is.ListNumbers([]byte("b"), []byte("x"), math.MinInt64, math.MaxInt64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(numbers) != "[2 3]" {
+		t.Errorf("all numbers %v", numbers)
+	}
+	numbers, err = is.ListNumbers([]byte("b"), []byte("x"), math.MinInt64, math.MaxInt64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(numbers) != "[2]" {
+		t.Errorf("first number %v", numbers)
+	}
+
+	// Read forwards through countingBackend, backwards otherwise
+	for _, is := range []*InfoStore{is, NewInfoStoreWithBackend(backend.Backend)} {
+		signed, err := is.Latest([]byte("a"), []byte("y"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := UnmarshalInfo(signed.Data); info == nil || info.Number != 2 {
+			t.Errorf("latest %v", info)
+		}
+		if _, err := is.Latest([]byte("a"), []byte("z")); err != ErrorNotFound {
+			t.Errorf("latest of unknown creator: %v", err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	is := NewInfoStoreWithBackend(NewMemoryBackend())
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(data []byte) *crypto.Signed {
+		return &crypto.Signed{
+			Pubkey:    pub,
+			Data:      data,
+			Signature: ed25519.Sign(priv, data),
+		}
+	}
+	page := []byte("page")
+
+	if err := is.Put(sign((&Info{Page: page, Number: 1, Revision: 1}).Marshal())); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := sign((&Info{Page: page, Number: 2, Revision: 1}).Marshal())
+	forged.Data = (&Info{Page: page, Number: 2, Revision: 2}).Marshal()
+	if err := is.Put(forged); err != ErrBadSignature {
+		t.Errorf("forged record: %v", err)
+	}
+	if _, err := is.Get(page, pub, 2); err != ErrorNotFound {
+		t.Errorf("forged record stored: %v", err)
+	}
+	if err := is.Put(forged, Trusted()); err != nil {
+		t.Errorf("trusted record: %v", err)
+	}
+
+	if err := is.Put(sign([]byte("garbage"))); !errors.Is(err, ErrMalformedInfo) {
+		t.Errorf("malformed record: %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := []byte("page")
+	putSigned := func(is *InfoStore, number, revision int64) {
+		t.Helper()
+		data := (&Info{Page: page, Number: number, Revision: revision}).Marshal()
+		err := is.Put(&crypto.Signed{
+			Pubkey:    pub,
+			Data:      data,
+			Signature: ed25519.Sign(priv, data),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var backends [2]*countingBackend
+	for i := range backends {
+		dir, err := NewDirBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = &countingBackend{Backend: dir}
+	}
+	a := NewInfoStoreWithBackend(backends[0])
+	b := NewInfoStoreWithBackend(backends[1])
+	for number := int64(1); number <= 50; number++ {
+		putSigned(a, number, 1)
+	}
+	for number := int64(25); number <= 75; number++ {
+		putSigned(b, number, 1)
+	}
+	putSigned(a, 40, 3)
+	putSigned(b, 30, 2)
+
+	// runSync returns the number of records skipped by a and b
+	runSync := func() (int, int) {
+		t.Helper()
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		type result struct {
+			skipped int
+			err     error
+		}
+		results := make(chan result, 1)
+		go func() {
+			skipped, err := b.ServeSync(c2)
+			results <- result{skipped, err}
+		}()
+		skipped, err := a.Sync(c1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return skipped, r.skipped
+	}
+	if skippedA, skippedB := runSync(); skippedA != 0 || skippedB != 0 {
+		t.Errorf("%d and %d records skipped", skippedA, skippedB)
+	}
+
+	expected := map[int64]int64{30: 2, 40: 3}
+	for _, is := range []*InfoStore{a, b} {
+		numbers, err := is.ListNumbers(page, pub, math.MinInt64, math.MaxInt64, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(numbers) != 75 {
+			t.Errorf("%d records after sync", len(numbers))
+		}
+		for number, revision := range expected {
+			signed, err := is.Get(page, pub, number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := UnmarshalInfo(signed.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Revision != revision {
+				t.Errorf("record %d has revision %d", number, info.Revision)
+			}
+		}
+	}
+
+	// Nothing is sent once the stores agree
+	for _, backend := range backends {
+		atomic.StoreInt64(&backend.gets, 0)
+	}
+	runSync()
+	for _, backend := range backends {
+		if gets := atomic.LoadInt64(&backend.gets); gets != 0 {
+			t.Errorf("%d records sent by second sync", gets)
+		}
+	}
+
+	// A record with a bad signature is skipped, and the rest synced
+	data := (&Info{Page: page, Number: 100, Revision: 1}).Marshal()
+	err = b.Put(&crypto.Signed{Pubkey: pub, Data: data, Signature: make([]byte, ed25519.SignatureSize)}, Trusted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSigned(b, 101, 1)
+	if skipped, _ := runSync(); skipped != 1 {
+		t.Errorf("%d records skipped", skipped)
+	}
+	if _, err := a.Get(page, pub, 100); err != ErrorNotFound {
+		t.Errorf("record with bad signature synced: %v", err)
+	}
+	if _, err := a.Get(page, pub, 101); err != nil {
+		t.Errorf("record after bad one: %v", err)
+	}
+}
+
+// messageConn checks the size of the sync messages written to it.
+type messageConn struct {
+	net.Conn
+	t   *testing.T
+	buf []byte
+}
+
+func (c *messageConn) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		var msg syncMessage
+		if err := json.Unmarshal(c.buf[:i], &msg); err != nil {
+			c.t.Error(err)
+		}
+		c.buf = c.buf[i+1:]
+		size := len(msg.Records) + len(msg.Want)
+		for _, r := range msg.Ranges {
+			size += 1 + len(r.Versions)
+		}
+		if size > syncMessageMax {
+			c.t.Errorf("message of %d items", size)
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func TestSyncLarge(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingBackend{Backend: NewMemoryBackend()}
+	a := NewInfoStoreWithBackend(backend)
+	b := NewInfoStoreWithBackend(NewMemoryBackend())
+	const n = 3000
+	for number := int64(0); number < n; number++ {
+		data := (&Info{Page: []byte("page"), Number: number, Revision: 1}).Marshal()
+		err := a.Put(&crypto.Signed{Pubkey: pub, Data: data, Signature: ed25519.Sign(priv, data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt64(&backend.records, 0)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.ServeSync(&messageConn{Conn: c2, t: t})
+		errs <- err
+	}()
+	if _, err := a.Sync(&messageConn{Conn: c1, t: t}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	numbers, err := b.ListNumbers([]byte("page"), pub, math.MinInt64, math.MaxInt64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(numbers) != n {
+		t.Errorf("%d records after sync", len(numbers))
+	}
+	// Every record is read to describe it and to compare it, not once per
+	// split of its range
+	if records := atomic.LoadInt64(&backend.records); records > 3*n {
+		t.Errorf("%d records read for %d records", records, n)
+	}
+}
+
+// countingBackend counts the records read with Get, which both sending and
+// putting a record during a sync do, the calls of List and the records they
+// read.
+type countingBackend struct {
+	Backend
+	gets    int64
+	lists   int64
+	records int64
+}
+
+func (b *countingBackend) List(from Key, fn func(k Key, data []byte) bool) error {
+	atomic.AddInt64(&b.lists, 1)
+	return b.Backend.List(from, func(k Key, data []byte) bool {
+		atomic.AddInt64(&b.records, 1)
+		return fn(k, data)
+	})
+}
+
+func (b *countingBackend) Get(k Key) ([]byte, error) {
+	atomic.AddInt64(&b.gets, 1)
+	return b.Backend.Get(k)
+}
+
+func TestTombstone(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(data []byte) *crypto.Signed {
+		return &crypto.Signed{
+			Pubkey:    pub,
+			Data:      data,
+			Signature: ed25519.Sign(priv, data),
+		}
+	}
+	page := []byte("page")
+	a := NewInfoStoreWithBackend(NewMemoryBackend())
+	b := NewInfoStoreWithBackend(NewMemoryBackend())
+	for _, is := range []*InfoStore{a, b} {
+		for number := int64(1); number <= 2; number++ {
+			if err := is.Put(sign((&Info{Page: page, Number: number, Revision: 1}).Marshal())); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for number, deletedAt := range map[int64]time.Time{1: old, 2: time.Now()} {
+		tombstone := &Tombstone{Page: page, Number: number, Revision: 1, Time: deletedAt}
+		if err := a.Put(sign(tombstone.Marshal())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Get(page, pub, 1); err != ErrorNotFound {
+		t.Errorf("get deleted record: %v", err)
+	}
+	// The same revision can't be put back
+	if err := a.Put(sign((&Info{Page: page, Number: 1, Revision: 1, Hash: []byte{0xff}}).Marshal())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get(page, pub, 1); err != ErrorNotFound {
+		t.Errorf("deleted record put back: %v", err)
+	}
+	if numbers, err := a.ListNumbers(page, pub, math.MinInt64, math.MaxInt64, 0); err != nil || len(numbers) != 0 {
+		t.Errorf("listed %v, %v", numbers, err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.ServeSync(c2)
+		errs <- err
+	}()
+	if _, err := a.Sync(c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(page, pub, 1); err != ErrorNotFound {
+		t.Errorf("deletion not synced: %v", err)
+	}
+
+	removed, err := a.CollectGarbage(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d tombstones", removed)
+	}
+	if _, err := a.backend.Get(Key{page, pub, 1}); err != ErrorNotFound {
+		t.Errorf("old tombstone kept: %v", err)
+	}
+	if _, err := a.backend.Get(Key{page, pub, 2}); err != nil {
+		t.Errorf("recent tombstone removed: %v", err)
+	}
+
+	// A newer revision brings the record back
+	if err := a.Put(sign((&Info{Page: page, Number: 2, Revision: 2}).Marshal())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get(page, pub, 2); err != nil {
+		t.Errorf("newer revision: %v", err)
+	}
+}
+
+type eventListener struct {
+	events  chan Event
+	dropped chan int
+	// called is signaled on every call, which then waits for block to be
+	// closed
+	called chan struct{}
+	block  chan struct{}
+}
+
+func (l *eventListener) InfoAdded(e Event) {
+	l.handle(e)
+}
+
+func (l *eventListener) InfoDeleted(e Event) {
+	l.handle(e)
+}
+
+func (l *eventListener) handle(e Event) {
+	select {
+	case l.called <- struct{}{}:
+	default:
+	}
+	<-l.block
+	l.events <- e
+}
+
+func (l *eventListener) EventsDropped(n int) {
+	l.dropped <- n
+}
+
+func TestListen(t *testing.T) {
+	is := NewInfoStoreWithBackend(NewMemoryBackend())
+	defer is.Close()
+	l := &eventListener{
+		events:  make(chan Event, 10),
+		dropped: make(chan int, 1),
+		called:  make(chan struct{}, 1),
+		block:   make(chan struct{}),
+	}
+	is.Listen(l, QueueSize(2))
+	page := []byte("page")
+	creator := []byte("creator")
+
+	// The listener is stuck with the first event, and two are queued, but
+	// Put goes on
+	put(t, is, creator, &Info{Page: page, Number: 1, Revision: 1})
+	<-l.called
+	for revision := int64(2); revision <= 5; revision++ {
+		put(t, is, creator, &Info{Page: page, Number: 1, Revision: revision})
+	}
+	if err := is.Delete(page, creator, 1); err != nil {
+		t.Fatal(err)
+	}
+	close(l.block)
+	timeout := time.After(5 * time.Second)
+	var events []Event
+	for len(events) < 3 {
+		select {
+		case e := <-l.events:
+			events = append(events, e)
+		case <-timeout:
+			t.Fatalf("received %d events", len(events))
+		}
+	}
+	if e := events[0]; e.Info == nil || e.Info.Revision != 1 || e.HasPrevious {
+		t.Errorf("first event %+v", e)
+	}
+	if e := events[1]; e.Info == nil || e.Info.Revision != 2 || !e.HasPrevious || e.PreviousRevision != 1 {
+		t.Errorf("second event %+v", e)
+	}
+	select {
+	case n := <-l.dropped:
+		if n != 3 {
+			t.Errorf("%d events dropped", n)
+		}
+	case <-timeout:
+		t.Fatal("no events dropped")
+	}
+}
+
+type unlistener struct {
+	is   *InfoStore
+	done chan struct{}
+}
+
+func (l *unlistener) InfoAdded(e Event) {
+	l.is.Unlisten(l)
+	close(l.done)
+}
+
+func (l *unlistener) InfoDeleted(e Event) {}
+
+func (l *unlistener) EventsDropped(n int) {}
+
+func TestUnlistenFromListener(t *testing.T) {
+	is := NewInfoStoreWithBackend(NewMemoryBackend())
+	defer is.Close()
+	l := &unlistener{is, make(chan struct{})}
+	is.Listen(l)
+	put(t, is, []byte("creator"), &Info{Page: []byte("page"), Number: 1, Revision: 1})
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener not called")
+	}
+	put(t, is, []byte("creator"), &Info{Page: []byte("page"), Number: 1, Revision: 2})
+}
+
+func collect(t *testing.T, it *IndexIterator) []string {
+	t.Helper()
+	var entries []string
+	for it.Next() {
+		k := it.Key()
+		entries = append(entries, fmt.Sprintf("%s/%s/%d", k.Page, k.Creator, k.Number))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	is, err := NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := []byte("x")
+	y := []byte("y")
+	put(t, is, x, &Info{Page: []byte("b"), Number: 1, Revision: 1})
+	put(t, is, y, &Info{Page: []byte("b"), Number: 1, Revision: 1})
+	put(t, is, x, &Info{Page: []byte("a"), Number: 2, Revision: 1})
+	put(t, is, x, &Info{Page: []byte("b"), Number: 1, Revision: 2})
+
+	if got := fmt.Sprint(collect(t, is.ByCreator(x))); got != "[a/x/2 b/x/1]" {
+		t.Errorf("by creator %s", got)
+	}
+	if got := fmt.Sprint(collect(t, is.ChangesSince(0))); got != "[b/y/1 a/x/2 b/x/1]" {
+		t.Errorf("changes %s", got)
+	}
+	it := is.ChangesSince(0)
+	it.Next()
+	if got := fmt.Sprint(collect(t, is.ChangesSince(it.Seq()))); got != "[a/x/2 b/x/1]" {
+		t.Errorf("changes since %d: %s", it.Seq(), got)
+	}
+
+	// Sequence numbers go on after reopening
+	is.Close()
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := is.Delete([]byte("a"), x, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(collect(t, is.ByCreator(x))); got != "[b/x/1]" {
+		t.Errorf("by creator after delete %s", got)
+	}
+	if got := fmt.Sprint(collect(t, is.ChangesSince(0))); got != "[b/y/1 b/x/1 a/x/2]" {
+		t.Errorf("changes after delete %s", got)
+	}
+
+	// A directory without an index gets one
+	is.Close()
+	if err := os.Remove(path.Join(dir, indexFile)); err != nil {
+		t.Fatal(err)
+	}
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	if got := fmt.Sprint(collect(t, is.ByCreator(x))); got != "[b/x/1]" {
+		t.Errorf("by creator after rebuild %s", got)
+	}
+	if got := fmt.Sprint(collect(t, is.ChangesSince(0))); got != "[b/x/1 b/y/1]" {
+		t.Errorf("changes after rebuild %s", got)
+	}
+
+	if err := NewInfoStoreWithBackend(NewMemoryBackend()).ByCreator(x).Err(); err != ErrorNoIndex {
+		t.Errorf("store without index: %v", err)
+	}
+}
+
+func TestIndexCrash(t *testing.T) {
+	dir := t.TempDir()
+	is, err := NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := []byte("x")
+	for number := int64(1); number <= 3; number++ {
+		put(t, is, x, &Info{Page: []byte("a"), Number: number, Revision: 1})
+	}
+	it := is.ChangesSince(0)
+	for it.Next() {
+	}
+	cursor := it.Seq()
+	// A crash between changing records and updating the index
+	index := is.index
+	is.index = nil
+	put(t, is, x, &Info{Page: []byte("b"), Number: 1, Revision: 1})
+	if err := is.Delete([]byte("a"), x, 2); err != nil {
+		t.Fatal(err)
+	}
+	is.Close()
+	index.backend.Close()
+
+	is, err = NewInfoStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	if got := fmt.Sprint(collect(t, is.ByCreator(x))); got != "[a/x/1 a/x/3 b/x/1]" {
+		t.Errorf("by creator after crash %s", got)
+	}
+	// A cursor from before the crash sees every record again, including
+	// the deleted one, and later changes
+	put(t, is, x, &Info{Page: []byte("c"), Number: 1, Revision: 1})
+	if got := fmt.Sprint(collect(t, is.ChangesSince(cursor))); got != "[a/x/1 a/x/3 b/x/1 a/x/2 c/x/1]" {
+		t.Errorf("changes since %d after crash %s", cursor, got)
+	}
+}
+
+// indexBackend counts the writes to an index, and fails them if err is set.
+type indexBackend struct {
+	*MemoryBackend
+	writes int
+	err    error
+}
+
+func (b *indexBackend) Put(k Key, data []byte) error {
+	b.writes++
+	if b.err != nil {
+		return b.err
+	}
+	return b.MemoryBackend.Put(k, data)
+}
+
+func (b *indexBackend) Delete(k Key) error {
+	b.writes++
+	if b.err != nil {
+		return b.err
+	}
+	return b.MemoryBackend.Delete(k)
+}
+
+func (b *indexBackend) Batch(ops []BatchOp) error {
+	b.writes++
+	if b.err != nil {
+		return b.err
+	}
+	return b.MemoryBackend.Batch(ops)
+}
+
+func TestIndexFailure(t *testing.T) {
+	ib := &indexBackend{MemoryBackend: NewMemoryBackend()}
+	is := NewInfoStoreWithBackend(NewMemoryBackend(), WithIndex(ib))
+	x := []byte("x")
+	put(t, is, x, &Info{Page: []byte("a"), Number: 1, Revision: 1})
+	put(t, is, x, &Info{Page: []byte("a"), Number: 1, Revision: 2})
+	if ib.writes != 2 {
+		t.Errorf("%d writes to the index for 2 puts", ib.writes)
+	}
+
+	// The record is stored even though the index fails
+	ib.err = errors.New("disk full")
+	put(t, is, x, &Info{Page: []byte("b"), Number: 1, Revision: 1})
+	if _, err := is.Get([]byte("b"), x, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := is.ByCreator(x).Err(); err != ErrorIndexStale {
+		t.Errorf("by creator with stale index: %v", err)
+	}
+	if err := is.RebuildIndex(); err == nil {
+		t.Error("rebuild succeeded with failing index")
+	}
+
+	ib.err = nil
+	if err := is.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(collect(t, is.ByCreator(x))); got != "[a/x/1 b/x/1]" {
+		t.Errorf("by creator after rebuild %s", got)
+	}
+}
+
+func TestKeyList(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomKey := func() Key {
+		return Key{[]byte{byte(rnd.Intn(4))}, []byte{byte(rnd.Intn(4))}, int64(rnd.Intn(50))}
+	}
+	present := map[string]Key{}
+	var initial []Key
+	for i := 0; i < 100; i++ {
+		k := randomKey()
+		if _, ok := present[memoryKey(k)]; !ok {
+			present[memoryKey(k)] = k
+			initial = append(initial, k)
+		}
+	}
+	sort.Slice(initial, func(i, j int) bool {
+		return compareKeys(initial[i], initial[j]) < 0
+	})
+	l := newKeyList(initial)
+	for i := 0; i < 5000; i++ {
+		k := randomKey()
+		if _, ok := present[memoryKey(k)]; ok {
+			l.remove(k)
+			delete(present, memoryKey(k))
+		} else {
+			l.insert(k)
+			present[memoryKey(k)] = k
+		}
+	}
+
+	var expected []Key
+	for _, k := range present {
+		expected = append(expected, k)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return compareKeys(expected[i], expected[j]) < 0
+	})
+	var got []Key
+	for n := l.seek(Key{Number: math.MinInt64}); n != nil; n = n.next[0] {
+		got = append(got, n.key)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("list holds %v, expected %v", got, expected)
+	}
+	from := Key{[]byte{2}, nil, 0}
+	i := sort.Search(len(expected), func(i int) bool {
+		return compareKeys(expected[i], from) >= 0
+	})
+	if n := l.seek(from); n == nil || compareKeys(n.key, expected[i]) != 0 {
+		t.Errorf("seek %v: %v, expected %v", from, n, expected[i])
+	}
+}
+
+func TestLogBackendOpenLarge(t *testing.T) {
+	name := path.Join(t.TempDir(), "log")
+	rnd := rand.New(rand.NewSource(1))
+	var buf []byte
+	const n = 100000
+	for i := 0; i < n; i++ {
+		k := Key{[]byte("page"), []byte("creator"), rnd.Int63()}
+		var err error
+		buf, err = appendLogEntry(buf, logPut, k, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(name, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLogBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var count int
+	var last Key
+	err = b.List(Key{Number: math.MinInt64}, func(k Key, data []byte) bool {
+		if count > 0 && compareKeys(k, last) <= 0 {
+			t.Errorf("%v listed after %v", k, last)
+			return false
+		}
+		count++
+		last = k
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("listed %d records", count)
+	}
+}
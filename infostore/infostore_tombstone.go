@@ -0,0 +1,192 @@
+package infostore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jakobvarmose/dc/crypto"
+)
+
+// Tombstone marks a record as deleted. It is signed and put like an Info,
+// and replaces the infos of the same page and number with a lower or equal
+// revision, so that a peer that still has one of them can't bring it back.
+type Tombstone struct {
+	Page     []byte
+	Number   int64
+	Revision int64
+	// Time is when the record was deleted. Tombstones are kept until some
+	// time after it, see CollectGarbage.
+	Time time.Time
+}
+
+// tombstoneMagic starts marshaled tombstones, telling them apart from infos.
+const tombstoneMagic = "\x00tombstone\x01"
+
+func (t *Tombstone) Marshal() []byte {
+	buf := []byte(tombstoneMagic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(t.Page)))
+	buf = append(buf, t.Page...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Number))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Revision))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Time.UnixNano()))
+	return buf
+}
+
+var errNotTombstone = errors.New("not a tombstone")
+
+func UnmarshalTombstone(data []byte) (*Tombstone, error) {
+	if !isTombstone(data) {
+		return nil, errNotTombstone
+	}
+	data = data[len(tombstoneMagic):]
+	if len(data) < 4 {
+		return nil, errors.New("tombstone too short")
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) != uint64(n)+24 {
+		return nil, errors.New("tombstone has wrong length")
+	}
+	return &Tombstone{
+		Page:     append([]byte{}, data[:n]...),
+		Number:   int64(binary.BigEndian.Uint64(data[n:])),
+		Revision: int64(binary.BigEndian.Uint64(data[n+8:])),
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(data[n+16:]))),
+	}, nil
+}
+
+func isTombstone(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(tombstoneMagic))
+}
+
+// version decides which of two records with the same key wins: the highest
+// revision, then a tombstone over an info, then for infos the highest hash.
+type version struct {
+	Revision int64
+	Hash     []byte `json:",omitempty"`
+	Deleted  bool   `json:",omitempty"`
+}
+
+func (v version) newer(old version) bool {
+	if v.Revision != old.Revision {
+		return v.Revision > old.Revision
+	}
+	if v.Deleted != old.Deleted {
+		return v.Deleted
+	}
+	return string(v.Hash) > string(old.Hash)
+}
+
+// record is a stored record, holding either an info or a tombstone.
+type record struct {
+	signed    *crypto.Signed
+	info      *Info
+	tombstone *Tombstone
+}
+
+func parseRecord(signed *crypto.Signed) (*record, error) {
+	if isTombstone(signed.Data) {
+		tombstone, err := UnmarshalTombstone(signed.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &record{signed: signed, tombstone: tombstone}, nil
+	}
+	info, err := UnmarshalInfo(signed.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &record{signed: signed, info: info}, nil
+}
+
+func unmarshalRecord(data []byte) (*record, error) {
+	signed, err := crypto.UnmarshalSigned(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecord(signed)
+}
+
+// key returns the key the record is stored under.
+func (r *record) key() Key {
+	if r.tombstone != nil {
+		return Key{r.tombstone.Page, r.signed.Pubkey, r.tombstone.Number}
+	}
+	return Key{r.info.Page, r.signed.Pubkey, r.info.Number}
+}
+
+func (r *record) version() version {
+	if r.tombstone != nil {
+		return version{Revision: r.tombstone.Revision, Deleted: true}
+	}
+	return version{Revision: r.info.Revision, Hash: r.info.Hash}
+}
+
+// CollectGarbage removes the tombstones of records deleted more than
+// retention ago, and returns how many it removed. Once a tombstone is
+// removed, a peer that still has an older version of the record can put it
+// again, so retention should be longer than the time it takes for deletions
+// to reach all peers.
+func (is *InfoStore) CollectGarbage(retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention)
+	var expired []Key
+	var err error
+	listErr := is.backend.List(Key{Number: math.MinInt64}, func(k Key, data []byte) bool {
+		var rec *record
+		rec, err = unmarshalRecord(data)
+		if err != nil {
+			err = fmt.Errorf("%x/%x/%d: %w", k.Page, k.Creator, k.Number, err)
+			return false
+		}
+		if rec.tombstone != nil && rec.tombstone.Time.Before(before) {
+			expired = append(expired, k)
+		}
+		return true
+	})
+	if listErr != nil {
+		return 0, listErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, k := range expired {
+		ok, err := is.removeTombstone(k, before)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// removeTombstone removes the record at k if it still is a tombstone from
+// before before.
+func (is *InfoStore) removeTombstone(k Key, before time.Time) (bool, error) {
+	lk := is.lock(k.Page, k.Creator, k.Number)
+	lk.Lock()
+	defer lk.Unlock()
+	data, err := is.backend.Get(k)
+	if err == ErrorNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rec, err := unmarshalRecord(data)
+	if err != nil || rec.tombstone == nil || !rec.tombstone.Time.Before(before) {
+		// Replaced meanwhile
+		return false, nil
+	}
+	err = is.backend.Delete(k)
+	if err == ErrorNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}